@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+
+	"example.com/m/v2/internal/api"
+	"example.com/m/v2/internal/auth"
+	"example.com/m/v2/internal/config"
+	"example.com/m/v2/internal/migrate"
+)
+
+// runMigrate implements "migrate up", "migrate down [steps]" and
+// "migrate status".
+func runMigrate(ctx context.Context, migrator *migrate.Migrator, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up | down [steps] | status")
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Applied %d migrations\n", applied)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+			steps = n
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Reverted %d migrations\n", reverted)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.AppliedAt != nil {
+				state = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			switch {
+			case s.Unknown:
+				state += " (not in this binary)"
+			case s.Changed:
+				state += " (modified since applied)"
+			}
+			fmt.Printf("%03d  %-24s %s\n", s.Version, s.Name, state)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q (use up, down or status)", args[0])
+	}
+	return nil
+}
+
+// runSync implements "sync nyt", the same refresh the server does on an
+// empty books table.
+func runSync(ctx context.Context, cfg *config.Config, args []string) error {
+	if len(args) != 1 || args[0] != "nyt" {
+		return errors.New("usage: sync nyt")
+	}
+	api.Init(cfg.NYT)
+	if err := api.UpdateBooksFromNYT(ctx); err != nil {
+		return err
+	}
+	fmt.Println("Books updated from the NYT API")
+	return nil
+}
+
+func runImport(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: import <file.json>")
+	}
+	count, err := api.ImportFile(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d books from %s\n", count, args[0])
+	return nil
+}
+
+// runUser implements "user create" and "user reset-password".
+func runUser(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: user create | reset-password")
+	}
+
+	flags := flag.NewFlagSet("user "+args[0], flag.ContinueOnError)
+	email := flags.String("email", "", "account email")
+	switch args[0] {
+	case "create":
+		name := flags.String("name", "", "display name")
+		admin := flags.Bool("admin", false, "grant the admin role")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *email == "" {
+			return errors.New("user create: -email is required")
+		}
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		id, err := auth.CreateUser(ctx, *email, *name, password, *admin)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created user %d (%s)\n", id, *email)
+	case "reset-password":
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *email == "" {
+			return errors.New("user reset-password: -email is required")
+		}
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		id, err := auth.ResetPassword(ctx, strings.TrimSpace(*email), password)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Password reset for user %d (%s)\n", id, *email)
+	default:
+		return fmt.Errorf("unknown user command %q (use create or reset-password)", args[0])
+	}
+	return nil
+}
+
+// readPassword prompts twice without echo on a terminal and otherwise reads
+// the first line of standard input, so scripts can pipe the password in.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("failed to read the password from standard input: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Repeat password: ")
+	confirm, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(password) != string(confirm) {
+		return "", errors.New("passwords don't match")
+	}
+	return string(password), nil
+}
@@ -9,15 +9,8 @@ until PGPASSWORD=$DB_PASSWORD psql -h "$DB_HOST" -U "$DB_USER" -d "$DB_NAME" -c
 done
 
 echo "PostgreSQL is ready"
-echo "Running migrations..."
 
-for migration in /app/migrations/*.sql; do
-  if [ -f "$migration" ]; then
-    echo "Applying: $(basename $migration)"
-    PGPASSWORD=$DB_PASSWORD psql -h "$DB_HOST" -U "$DB_USER" -d "$DB_NAME" -f "$migration"
-  fi
-done
-
-echo "Migrations completed - starting application"
+# Migrations are embedded in the binary and applied on startup
+# (MIGRATE_ON_START=true) or with "./main migrate up".
 
 exec "$@"
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"example.com/m/v2/internal/models"
+)
+
+// ImportFile replaces the books with the contents of a JSON file: either a
+// saved NYT overview response or an array shaped like the "books" of /api/books.
+func ImportFile(ctx context.Context, path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var books []models.Book
+	if err := json.Unmarshal(data, &books); err != nil {
+		var nytResp models.NYTResponse
+		if nytErr := json.Unmarshal(data, &nytResp); nytErr != nil {
+			return 0, fmt.Errorf("%s: not a list of books or an NYT response: %v", path, err)
+		}
+		books = booksFromNYT(nytResp)
+	}
+
+	for i, b := range books {
+		if b.Title == "" || b.Author == "" {
+			return 0, fmt.Errorf("%s: book %d needs a title and an author", path, i+1)
+		}
+	}
+	if len(books) == 0 {
+		return 0, fmt.Errorf("%s: no books found", path)
+	}
+	return len(books), ReplaceBooks(ctx, books)
+}
@@ -1,30 +1,82 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
-	"os"
+	"net/url"
+	"time"
 
+	"example.com/m/v2/internal/config"
 	"example.com/m/v2/internal/database"
+	"example.com/m/v2/internal/metrics"
 	"example.com/m/v2/internal/models"
+	"example.com/m/v2/internal/tracing"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
-func UpdateBooksFromNYT() error {
-	apikey := os.Getenv("API_KEY")
-	if apikey == "" {
-		return fmt.Errorf("API_KEY not found in environment")
+var nytURL = "https://api.nytimes.com/svc/books/v3/lists/overview.json"
+
+// The key is added below the tracing transport, so spans and the errors the
+// client wraps with the request URL never contain it.
+var nytClient = &http.Client{
+	Timeout:   30 * time.Second,
+	Transport: otelhttp.NewTransport(apiKeyTransport{http.DefaultTransport}),
+}
+
+var nytAPIKey string
+
+type apiKeyTransport struct {
+	base http.RoundTripper
+}
+
+func (t apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target, err := url.Parse(nytURL)
+	if err != nil || req.URL.Host != target.Host {
+		return t.base.RoundTrip(req)
 	}
+	req = req.Clone(req.Context())
+	q := req.URL.Query()
+	q.Set("api-key", nytAPIKey)
+	req.URL.RawQuery = q.Encode()
+	return t.base.RoundTrip(req)
+}
+
+func Init(cfg config.NYT) {
+	nytAPIKey = cfg.APIKey
+}
+
+func UpdateBooksFromNYT(ctx context.Context) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "nyt.ingest")
+	start := time.Now()
+	defer func() {
+		metrics.NYTIngestDuration.Observe(time.Since(start).Seconds())
+		metrics.NYTIngestRuns.WithLabelValues(metrics.Outcome(err)).Inc()
+		tracing.End(span, err)
+	}()
 
-	url := fmt.Sprintf("https://api.nytimes.com/svc/books/v3/lists/overview.json?api-key=%s", apikey)
-	resp, err := http.Get(url)
+	if nytAPIKey == "" {
+		return fmt.Errorf("NYT API key is not configured (API_KEY)")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, nytURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := nytClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to connect to the API: %v", err)
 	}
 	defer resp.Body.Close()
 
+	// Errors such as 401 or 429 still come with a JSON body that decodes to
+	// no books, which would empty the catalogue.
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("NYT API returned %s", resp.Status)
+	}
+
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return fmt.Errorf("error reading response: %v", err)
@@ -34,39 +86,71 @@ func UpdateBooksFromNYT() error {
 	if err := json.Unmarshal(body, &nytResp); err != nil {
 		return fmt.Errorf("error parsing JSON: %v", err)
 	}
+	books := booksFromNYT(nytResp)
+	if len(books) == 0 {
+		return fmt.Errorf("NYT API returned no books")
+	}
+	return ReplaceBooks(ctx, books)
+}
 
-	_, err = database.DB.Exec("DELETE FROM books")
-	if err != nil {
-		return fmt.Errorf("error clearing books table: %v", err)
+func booksFromNYT(resp models.NYTResponse) []models.Book {
+	var books []models.Book
+	for _, list := range resp.Results.Lists {
+		for _, b := range list.Books {
+			book := models.Book{
+				Title:       b.Title,
+				Author:      b.Author,
+				Description: b.Description,
+				Publisher:   b.Publisher,
+				Image:       b.Image,
+				AmazonURL:   b.AmazonURL,
+				Rank:        b.Rank,
+			}
+			for _, link := range b.BuyLinks {
+				book.Links = append(book.Links, models.Link{Name: link.Name, Url: link.Url})
+			}
+			books = append(books, book)
+		}
 	}
-	_, err = database.DB.Exec("DELETE FROM book_links")
+	return books
+}
+
+// ReplaceBooks swaps the whole catalogue for books in one transaction, so
+// readers never see an empty or half-filled table.
+func ReplaceBooks(ctx context.Context, books []models.Book) error {
+	tx, err := database.DB.BeginTx(ctx, nil)
 	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM book_links"); err != nil {
 		return fmt.Errorf("error clearing book_links table: %v", err)
 	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM books"); err != nil {
+		return fmt.Errorf("error clearing books table: %v", err)
+	}
 
-	for _, list := range nytResp.Results.Lists {
-		for _, b := range list.Books {
-			var bookID int
-			err := database.DB.QueryRow(`
-				INSERT INTO books (title, author, description, publisher, image, amazon_url, rank)
-				VALUES ($1, $2, $3, $4, $5, $6, $7)
-				RETURNING id
-			`, b.Title, b.Author, b.Description, b.Publisher, b.Image, b.AmazonURL, b.Rank).Scan(&bookID)
-			if err != nil {
-				log.Println("Error adding book:", err)
-				continue
-			}
+	for _, b := range books {
+		var bookID int
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO books (title, author, description, publisher, image, amazon_url, rank)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			RETURNING id
+		`, b.Title, b.Author, b.Description, b.Publisher, b.Image, b.AmazonURL, b.Rank).Scan(&bookID)
+		if err != nil {
+			return fmt.Errorf("failed to add book %q: %v", b.Title, err)
+		}
 
-			for _, link := range b.BuyLinks {
-				_, err := database.DB.Exec(`
-					INSERT INTO book_links (book_id, name, url)
-					VALUES ($1, $2, $3)
-				`, bookID, link.Name, link.Url)
-				if err != nil {
-					log.Println("Failed to insert link:", err)
-				}
+		for _, link := range b.Links {
+			_, err := tx.ExecContext(ctx, `
+				INSERT INTO book_links (book_id, name, url)
+				VALUES ($1, $2, $3)
+			`, bookID, link.Name, link.Url)
+			if err != nil {
+				return fmt.Errorf("failed to add link for book %q: %v", b.Title, err)
 			}
 		}
 	}
-	return nil
+	return tx.Commit()
 }
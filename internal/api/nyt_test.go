@@ -0,0 +1,132 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const testAPIKey = "secret-nyt-key"
+
+func withNYT(t *testing.T, server *httptest.Server) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	oldURL, oldKey := nytURL, nytAPIKey
+	nytURL, nytAPIKey = server.URL+"/svc/books/v3/lists/overview.json", testAPIKey
+	t.Cleanup(func() {
+		nytURL, nytAPIKey = oldURL, oldKey
+		otel.SetTracerProvider(previous)
+	})
+	return recorder
+}
+
+func TestNYTClientKeepsKeyOutOfSpans(t *testing.T) {
+	var gotKey string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotKey = r.URL.Query().Get("api-key")
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	recorder := withNYT(t, server)
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, nytURL, nil)
+	resp, err := nytClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if gotKey != testAPIKey {
+		t.Errorf("server got api-key %q, want %q", gotKey, testAPIKey)
+	}
+	spans := recorder.Ended()
+	if len(spans) == 0 {
+		t.Fatal("no client span recorded")
+	}
+	sawURL := false
+	for _, span := range spans {
+		for _, attr := range span.Attributes() {
+			if attr.Key == "url.full" {
+				sawURL = true
+			}
+			if strings.Contains(attr.Value.Emit(), testAPIKey) {
+				t.Errorf("span %q attribute %s contains the API key", span.Name(), attr.Key)
+			}
+		}
+	}
+	if !sawURL {
+		t.Error("client span has no url.full attribute")
+	}
+}
+
+func TestNYTClientKeepsKeyOutOfErrors(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	withNYT(t, server)
+	server.Close()
+
+	err := UpdateBooksFromNYT(context.Background())
+	if err == nil {
+		t.Fatal("expected a connection error")
+	}
+	if strings.Contains(err.Error(), testAPIKey) {
+		t.Errorf("error contains the API key: %v", err)
+	}
+}
+
+func TestAPIKeyTransportOnlyAddsKeyForNYT(t *testing.T) {
+	var gotQuery string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.RawQuery
+	}))
+	defer server.Close()
+	withNYT(t, server)
+	nytURL = "https://api.nytimes.com/svc/books/v3/lists/overview.json"
+
+	resp, err := nytClient.Get(server.URL + "/elsewhere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if gotQuery != "" {
+		t.Errorf("key sent to another host: %q", gotQuery)
+	}
+}
+
+// Every case fails before ReplaceBooks, which would need the database.
+func TestUpdateBooksFromNYTKeepsCatalogueOnBadResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string
+	}{
+		{"unauthorized", http.StatusUnauthorized, `{"fault":{"faultstring":"Invalid ApiKey"}}`, "401"},
+		{"rate limited", http.StatusTooManyRequests, `{"fault":{"faultstring":"Rate limit quota violation"}}`, "429"},
+		{"server error", http.StatusBadGateway, `{}`, "502"},
+		{"no books", http.StatusOK, `{"status":"OK","results":{"lists":[]}}`, "no books"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+			withNYT(t, server)
+
+			err := UpdateBooksFromNYT(context.Background())
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("UpdateBooksFromNYT() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
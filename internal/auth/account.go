@@ -0,0 +1,367 @@
+package auth
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/lib/pq"
+
+	"example.com/m/v2/internal/database"
+	"example.com/m/v2/internal/middleware"
+	"example.com/m/v2/internal/models"
+	"example.com/m/v2/internal/services"
+	"example.com/m/v2/internal/views"
+)
+
+func getDeletionGracePeriod() time.Duration {
+	return time.Duration(settings.Accounts.DeletionGraceDays) * 24 * time.Hour
+}
+
+type exportProfile struct {
+	ID                  int        `json:"id"`
+	Name                string     `json:"name"`
+	Email               string     `json:"email"`
+	EmailVerifiedAt     *time.Time `json:"email_verified_at"`
+	Role                string     `json:"role"`
+	AvatarURL           *string    `json:"avatar_url"`
+	TwoFactorEnabled    bool       `json:"two_factor_enabled"`
+	CreatedAt           time.Time  `json:"created_at"`
+	DeletionRequestedAt *time.Time `json:"deletion_requested_at"`
+}
+
+type exportIdentity struct {
+	Provider    string     `json:"provider"`
+	Email       *string    `json:"email"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+}
+
+type exportAPIToken struct {
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+type exportEmailVerification struct {
+	Email     string     `json:"email"`
+	CreatedAt time.Time  `json:"created_at"`
+	UsedAt    *time.Time `json:"used_at"`
+}
+
+func collectExport(ctx context.Context, userID interface{}) (map[string]interface{}, *exportProfile, error) {
+	var p exportProfile
+	err := database.DB.QueryRow(`
+		SELECT id, COALESCE(name, ''), email, email_verified_at, COALESCE(role, 'user'), avatar_url,
+			totp_enabled_at IS NOT NULL, created_at, deletion_requested_at
+		FROM users
+		WHERE id = $1
+	`, userID).Scan(&p.ID, &p.Name, &p.Email, &p.EmailVerifiedAt, &p.Role, &p.AvatarURL,
+		&p.TwoFactorEnabled, &p.CreatedAt, &p.DeletionRequestedAt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	identities := []exportIdentity{}
+	rows, err := database.DB.Query(`
+		SELECT provider, email, created_at, last_login_at
+		FROM user_identities
+		WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var i exportIdentity
+		if err := rows.Scan(&i.Provider, &i.Email, &i.CreatedAt, &i.LastLoginAt); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		identities = append(identities, i)
+	}
+	rows.Close()
+
+	tokens := []exportAPIToken{}
+	rows, err = database.DB.Query(`
+		SELECT name, scopes, created_at, last_used_at, revoked_at
+		FROM api_tokens
+		WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var t exportAPIToken
+		if err := rows.Scan(&t.Name, pq.Array(&t.Scopes), &t.CreatedAt, &t.LastUsedAt, &t.RevokedAt); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	rows.Close()
+
+	verifications := []exportEmailVerification{}
+	rows, err = database.DB.Query(`
+		SELECT email, created_at, used_at
+		FROM email_verifications
+		WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var v exportEmailVerification
+		if err := rows.Scan(&v.Email, &v.CreatedAt, &v.UsedAt); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		verifications = append(verifications, v)
+	}
+	rows.Close()
+
+	activity, err := database.ListAuditEvents(ctx, models.AuditFilter{UserID: p.ID, Limit: 10000})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return map[string]interface{}{
+		"profile.json":             p,
+		"linked_accounts.json":     identities,
+		"api_tokens.json":          tokens,
+		"email_verifications.json": verifications,
+		"security_activity.json":   activity,
+	}, &p, nil
+}
+
+func ExportDataHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID")
+	if userID == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	files, profile, err := collectExport(r.Context(), userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to collect data export", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	middleware.SecurityLogger("DATA_EXPORT", r, userID.(int), nil)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="books-account-%d-%s.zip"`, profile.ID, time.Now().Format("20060102")))
+
+	zw := zip.NewWriter(w)
+	defer zw.Close()
+
+	for name, content := range files {
+		f, err := zw.Create(name)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to write data export", "error", err)
+			return
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(content); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write data export", "error", err)
+			return
+		}
+	}
+
+	if profile.AvatarURL == nil || *profile.AvatarURL == "" {
+		return
+	}
+	avatar, err := services.OpenAvatar(r.Context(), *profile.AvatarURL)
+	if err != nil {
+		if !errors.Is(err, services.ErrExternalAvatar) {
+			slog.WarnContext(r.Context(), "failed to read avatar for data export", "error", err)
+		}
+		return
+	}
+	defer avatar.Close()
+
+	ext := path.Ext(*profile.AvatarURL)
+	if ext == "" {
+		ext = ".jpg"
+	}
+	f, err := zw.Create("avatar" + ext)
+	if err != nil {
+		return
+	}
+	if _, err := io.Copy(f, avatar); err != nil {
+		slog.WarnContext(r.Context(), "failed to write avatar to data export", "error", err)
+	}
+}
+
+func RequestDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID")
+	if userID == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	ok, err := confirmIdentity(r, userID.(int), true)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		views.AddFlash(w, r, views.ErrorFlash(reauthFailedMessage))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	var email string
+	err = database.DB.QueryRow(`
+		UPDATE users
+		SET deletion_requested_at = COALESCE(deletion_requested_at, now())
+		WHERE id = $1
+		RETURNING email
+	`, userID).Scan(&email)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	middleware.SecurityLogger("ACCOUNT_DELETION_REQUESTED", r, userID.(int), nil)
+
+	deleteAt := time.Now().Add(getDeletionGracePeriod())
+	body := fmt.Sprintf(
+		"Hello!\n\nWe received a request to delete your account. It will be permanently deleted on %s.\n\n"+
+			"If you change your mind, sign in before then and cancel the deletion on your profile page.\n",
+		deleteAt.Format("January 2, 2006"),
+	)
+	if err := services.SendEmail(r.Context(), email, "Your account is scheduled for deletion", body); err != nil {
+		slog.ErrorContext(r.Context(), "failed to send deletion notice", "error", err)
+	}
+
+	LogoutHandler(w, r)
+}
+
+func CancelDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID")
+	if userID == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if _, err := database.DB.Exec("UPDATE users SET deletion_requested_at = NULL WHERE id = $1", userID); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	middleware.SecurityLogger("ACCOUNT_DELETION_CANCELLED", r, userID.(int), nil)
+	views.AddFlash(w, r, views.SuccessFlash("Account deletion cancelled"))
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+// StartAccountPurger purges accounts past their grace period and expired
+// login throttles now and then every interval until ctx is done. The
+// returned channel is closed once the purger has stopped.
+func StartAccountPurger(ctx context.Context, interval time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		purgeDeletedAccounts()
+		expireLoginThrottles()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				purgeDeletedAccounts()
+				expireLoginThrottles()
+			}
+		}
+	}()
+	return done
+}
+
+func purgeDeletedAccounts() {
+	rows, err := database.DB.Query(`
+		SELECT id, email
+		FROM users
+		WHERE deletion_requested_at < now() - make_interval(secs => $1)
+	`, getDeletionGracePeriod().Seconds())
+	if err != nil {
+		slog.Error("failed to find accounts to delete", "error", err)
+		return
+	}
+
+	type account struct {
+		id    int
+		email string
+	}
+	var accounts []account
+	for rows.Next() {
+		var a account
+		if err := rows.Scan(&a.id, &a.email); err != nil {
+			slog.Error("failed to find accounts to delete", "error", err)
+			continue
+		}
+		accounts = append(accounts, a)
+	}
+	rows.Close()
+
+	for _, a := range accounts {
+		deleted, err := purgeAccount(a.id)
+		if err != nil {
+			slog.Warn("failed to delete account, will retry", "subject_id", a.id, "error", err)
+			continue
+		}
+		if !deleted {
+			continue
+		}
+		clearLoginFailures(a.email)
+		slog.Info("account permanently deleted", "subject_id", a.id)
+	}
+}
+
+// purgeAccount deletes the row, rechecking the grace period so a deletion
+// cancelled since the accounts were listed keeps both the account and its
+// avatar. The avatar goes inside the same transaction: if removing it fails
+// the row is kept and the next run retries.
+func purgeAccount(id int) (bool, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		DELETE FROM users
+		WHERE id = $1 AND deletion_requested_at < now() - make_interval(secs => $2)
+	`, id, getDeletionGracePeriod().Seconds())
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return false, err
+	}
+
+	if err := services.DeleteAvatar(context.Background(), id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
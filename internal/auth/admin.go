@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"example.com/m/v2/internal/database"
+	"example.com/m/v2/internal/middleware"
+	"example.com/m/v2/internal/models"
+	"example.com/m/v2/internal/views"
+)
+
+var adminUsersTmpl = views.Must("layout.html", "admin_users.html")
+var adminAuditTmpl = views.Must("layout.html", "admin_audit.html")
+
+type adminUser struct {
+	ID               int
+	Email            string
+	Name             string
+	Role             string
+	TwoFactorEnabled bool
+	LockedUntil      *time.Time
+	CreatedAt        time.Time
+}
+
+// ipLock is an active lock on a client address. A user may stay locked out
+// by one after their account lock is cleared.
+type ipLock struct {
+	IP          string
+	Failures    int
+	LockedUntil time.Time
+}
+
+func AdminUsersPage(w http.ResponseWriter, r *http.Request) {
+	rows, err := database.DB.Query(`
+		SELECT u.id, u.email, COALESCE(u.name, ''), COALESCE(u.role, 'user'), u.totp_enabled_at IS NOT NULL,
+			CASE WHEN t.locked_until > now() THEN t.locked_until END, u.created_at
+		FROM users u
+		LEFT JOIN login_throttles t ON t.key = 'account:' || lower(u.email)
+		ORDER BY u.id
+	`)
+	if err != nil {
+		http.Error(w, "Error database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var users []adminUser
+	for rows.Next() {
+		var u adminUser
+		if err := rows.Scan(&u.ID, &u.Email, &u.Name, &u.Role, &u.TwoFactorEnabled, &u.LockedUntil, &u.CreatedAt); err != nil {
+			http.Error(w, "Error database", http.StatusInternalServerError)
+			return
+		}
+		users = append(users, u)
+	}
+
+	locks, err := activeIPLocks()
+	if err != nil {
+		http.Error(w, "Error database", http.StatusInternalServerError)
+		return
+	}
+
+	data := PageData{
+		PageCSS: "profile",
+		Data: struct {
+			Users   []adminUser
+			IPLocks []ipLock
+		}{users, locks},
+	}
+	adminUsersTmpl.Render(w, r, &data)
+}
+
+func AdminResetTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := resetTwoFactor(id); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	// Whoever got the reset may not be the account owner, so sign out every
+	// existing session.
+	if _, err := database.DB.Exec("UPDATE users SET session_version = session_version + 1 WHERE id = $1", id); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	middleware.SecurityLogger("2FA_RESET", r, id, nil)
+	views.AddFlash(w, r, views.SuccessFlash("Two-factor authentication reset"))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+func AdminUnlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var email string
+	if err := database.DB.QueryRow("SELECT email FROM users WHERE id = $1", id).Scan(&email); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	clearLoginFailures(email)
+
+	middleware.SecurityLogger("ACCOUNT_UNLOCKED", r, id, middleware.Metadata{"email": email})
+	views.AddFlash(w, r, views.SuccessFlash("Account unlocked. Locked addresses are listed separately"))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+func activeIPLocks() ([]ipLock, error) {
+	rows, err := database.DB.Query(`
+		SELECT substr(key, length($1) + 1), failures, locked_until
+		FROM login_throttles
+		WHERE key LIKE $1 || '%' AND locked_until > now()
+		ORDER BY locked_until DESC
+	`, ipThrottle.prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var locks []ipLock
+	for rows.Next() {
+		var l ipLock
+		if err := rows.Scan(&l.IP, &l.Failures, &l.LockedUntil); err != nil {
+			return nil, err
+		}
+		locks = append(locks, l)
+	}
+	return locks, rows.Err()
+}
+
+func AdminUnlockIPHandler(w http.ResponseWriter, r *http.Request) {
+	ip := r.FormValue("ip")
+	res, err := database.DB.Exec("DELETE FROM login_throttles WHERE key = $1", ipThrottle.prefix+ip)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	middleware.SecurityLogger("IP_UNLOCKED", r, 0, middleware.Metadata{"ip": ip})
+	views.AddFlash(w, r, views.SuccessFlash("Address "+ip+" unlocked"))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+func AdminChangeRoleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	role := r.FormValue("role")
+	if role != "admin" && role != "user" {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+	if id == r.Context().Value("userID") {
+		views.AddFlash(w, r, views.ErrorFlash("You cannot change your own role"))
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	var previous string
+	err = database.DB.QueryRow(`
+		UPDATE users u
+		SET role = $2
+		FROM (SELECT COALESCE(role, 'user') AS role FROM users WHERE id = $1) prev
+		WHERE u.id = $1
+		RETURNING prev.role
+	`, id, role).Scan(&previous)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if previous != role {
+		middleware.SecurityLogger("ROLE_CHANGED", r, id, middleware.Metadata{"from": previous, "to": role})
+	}
+	views.AddFlash(w, r, views.SuccessFlash("Role updated"))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+type auditPageData struct {
+	Events     []models.AuditEvent
+	EventTypes []string
+	Filter     url.Values
+	Page       int
+	PrevURL    string
+	NextURL    string
+}
+
+const auditPageSize = 50
+
+func AdminAuditPage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	page, err := strconv.Atoi(q.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	filter := models.AuditFilter{
+		Event:  q.Get("event"),
+		Email:  strings.TrimSpace(q.Get("email")),
+		Limit:  auditPageSize + 1,
+		Offset: (page - 1) * auditPageSize,
+	}
+	if since, err := time.Parse("2006-01-02", q.Get("since")); err == nil {
+		filter.Since = since
+	}
+	if until, err := time.Parse("2006-01-02", q.Get("until")); err == nil {
+		filter.Until = until.AddDate(0, 0, 1)
+	}
+
+	events, err := database.ListAuditEvents(r.Context(), filter)
+	if err != nil {
+		http.Error(w, "Error database", http.StatusInternalServerError)
+		return
+	}
+	eventTypes, err := database.ListAuditEventTypes(r.Context())
+	if err != nil {
+		http.Error(w, "Error database", http.StatusInternalServerError)
+		return
+	}
+
+	pageURL := func(p int) string {
+		v := url.Values{}
+		for key, values := range q {
+			v[key] = values
+		}
+		v.Set("page", strconv.Itoa(p))
+		return "/admin/audit?" + v.Encode()
+	}
+
+	result := auditPageData{Events: events, EventTypes: eventTypes, Filter: q, Page: page}
+	if len(events) > auditPageSize {
+		result.Events = events[:auditPageSize]
+		result.NextURL = pageURL(page + 1)
+	}
+	if page > 1 {
+		result.PrevURL = pageURL(page - 1)
+	}
+
+	data := PageData{
+		PageCSS: "profile",
+		Data:    result,
+	}
+	adminAuditTmpl.Render(w, r, &data)
+}
@@ -2,30 +2,38 @@ package auth
 
 import (
 	"fmt"
-	"html/template"
+	"log/slog"
 	"net/http"
-	"os"
 	"time"
 
-	"github.com/gorilla/csrf"
-
+	"example.com/m/v2/internal/config"
 	"example.com/m/v2/internal/database"
 	"example.com/m/v2/internal/middleware"
+	"example.com/m/v2/internal/models"
 	"example.com/m/v2/internal/utils"
+	"example.com/m/v2/internal/views"
 )
 
-var registerTmpl = template.Must(template.ParseFiles("internal/views/layout.html", "internal/views/register.html"))
-var loginTmpl = template.Must(template.ParseFiles("internal/views/layout.html", "internal/views/login.html"))
-var profileTmpl = template.Must(template.ParseFiles("internal/views/layout.html", "internal/views/profile.html"))
+var registerTmpl = views.Must("layout.html", "register.html")
+var loginTmpl = views.Must("layout.html", "login.html")
+var profileTmpl = views.Must("layout.html", "profile.html")
+
+var settings = config.Default()
+
+// Init keeps the settings the handlers need, such as the base URL for links
+// in emails and the account deletion grace period.
+func Init(cfg *config.Config) {
+	settings = cfg
+}
 
 type FormData map[string]interface{}
 
 type PageData struct {
-	Flash     string
+	views.Layout
 	Form      FormData
-	User      interface{}
-	CSRFToken string
 	PageCSS   string
+	Providers []*OIDCProvider
+	Data      interface{}
 }
 
 func ProfilePage(w http.ResponseWriter, r *http.Request) {
@@ -36,21 +44,28 @@ func ProfilePage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var user struct {
-		ID        int
-		Name      string
-		Email     string
-		AvatarURL string
-		CreatedAt time.Time
+		ID               int
+		Name             string
+		Email            string
+		AvatarURL        string
+		EmailVerified    bool
+		TwoFactorEnabled bool
+		HasPassword      bool
+		IsAdmin          bool
+		CreatedAt        time.Time
+		DeletionDate     *time.Time
 	}
 
 	defaultAvatar := getDefaultAvatarURL()
 
 	var avatarURL *string
+	var emailVerifiedAt, totpEnabledAt, deletionRequestedAt *time.Time
+	var role *string
 	err := database.DB.QueryRow(`
-		SELECT id, name, email, created_at, avatar_url 
+		SELECT id, name, email, created_at, avatar_url, email_verified_at, totp_enabled_at, role, deletion_requested_at, password_hash <> ''
 		FROM users 
 		WHERE id = $1
-	`, userID).Scan(&user.ID, &user.Name, &user.Email, &user.CreatedAt, &avatarURL)
+	`, userID).Scan(&user.ID, &user.Name, &user.Email, &user.CreatedAt, &avatarURL, &emailVerifiedAt, &totpEnabledAt, &role, &deletionRequestedAt, &user.HasPassword)
 
 	if err != nil {
 		http.Error(w, fmt.Sprintf("User not found: %v", err), http.StatusNotFound)
@@ -62,27 +77,54 @@ func ProfilePage(w http.ResponseWriter, r *http.Request) {
 	} else {
 		user.AvatarURL = defaultAvatar
 	}
+	user.EmailVerified = emailVerifiedAt != nil
+	user.TwoFactorEnabled = totpEnabledAt != nil
+	user.IsAdmin = role != nil && *role == "admin"
+	if deletionRequestedAt != nil {
+		deletionDate := deletionRequestedAt.Add(getDeletionGracePeriod())
+		user.DeletionDate = &deletionDate
+	}
 
-	flash := r.URL.Query().Get("flash")
-	data := PageData{
-		User:      user,
-		Flash:     flash,
-		CSRFToken: csrf.Token(r),
-		PageCSS:   "profile",
+	tokens, err := listAPITokens(userID)
+	if err != nil {
+		http.Error(w, "Error database", http.StatusInternalServerError)
+		return
 	}
 
-	err = profileTmpl.Lookup("layout").Execute(w, data)
+	activity, err := database.ListAuditEvents(r.Context(), models.AuditFilter{UserID: user.ID, Limit: 20})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Template error: %v", err), http.StatusInternalServerError)
+		http.Error(w, "Error database", http.StatusInternalServerError)
+		return
+	}
+
+	var providers []*OIDCProvider
+	if !user.HasPassword {
+		if providers, err = linkedProviders(user.ID); err != nil {
+			http.Error(w, "Error database", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	data := PageData{
+		Layout:    views.Layout{User: user},
+		PageCSS:   "profile",
+		Providers: providers,
+		Data: struct {
+			APITokens []APIToken
+			Scopes    []string
+			Activity  []models.AuditEvent
+		}{tokens, APITokenScopes, activity},
 	}
+
+	profileTmpl.Render(w, r, &data)
 }
 
 func getDefaultAvatarURL() string {
-	defaultURL := os.Getenv("DEFAULT_AVATAR_URL")
-	if defaultURL == "" {
-		return "/static/default-avatar.png"
-	}
-	return defaultURL
+	return settings.Accounts.DefaultAvatarURL
+}
+
+func getAppBaseURL() string {
+	return settings.BaseURL
 }
 
 func LogoutHandler(w http.ResponseWriter, r *http.Request) {
@@ -91,7 +133,7 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 		Value:    "",
 		Path:     "/",
 		HttpOnly: true,
-		Secure:   true,
+		Secure:   middleware.SecureCookies(),
 		SameSite: http.SameSiteStrictMode,
 		MaxAge:   -1,
 	})
@@ -100,13 +142,9 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 
 func RegisterPage(w http.ResponseWriter, r *http.Request) {
 	data := PageData{
-		CSRFToken: csrf.Token(r),
-		PageCSS:   "register",
-	}
-	err := registerTmpl.Lookup("layout").Execute(w, data)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Template error: %v", err), http.StatusInternalServerError)
+		PageCSS: "register",
 	}
+	registerTmpl.Render(w, r, &data)
 }
 
 func RegisterSubmit(w http.ResponseWriter, r *http.Request) {
@@ -116,36 +154,21 @@ func RegisterSubmit(w http.ResponseWriter, r *http.Request) {
 	}
 
 	name := utils.SanitizeInput(r.FormValue("name"))
-	email := utils.SanitizeInput(r.FormValue("email"))
+	email := utils.NormalizeEmail(r.FormValue("email"))
 	password := r.FormValue("password")
 	passwordConfirm := r.FormValue("password_confirm")
 
 	if !utils.IsValidEmail(email) {
-		registerTmpl.Lookup("layout").Execute(w, PageData{
-			Flash:     "Invalid email format",
-			Form:      FormData{"Name": name, "Email": email},
-			CSRFToken: csrf.Token(r),
-			PageCSS:   "register",
-		})
+		renderRegister(w, r, "Invalid email format", FormData{"Name": name, "Email": email})
 		return
 	}
 
 	if password != passwordConfirm {
-		registerTmpl.Lookup("layout").Execute(w, PageData{
-			Flash:     "Passwords don't match",
-			Form:      FormData{"Name": name, "Email": email},
-			CSRFToken: csrf.Token(r),
-			PageCSS:   "register",
-		})
+		renderRegister(w, r, "Passwords don't match", FormData{"Name": name, "Email": email})
 		return
 	}
 	if len(password) < 8 {
-		registerTmpl.Lookup("layout").Execute(w, PageData{
-			Flash:     "The password must contain at least 8 characters",
-			Form:      FormData{"Name": name, "Email": email},
-			CSRFToken: csrf.Token(r),
-			PageCSS:   "register",
-		})
+		renderRegister(w, r, "The password must contain at least 8 characters", FormData{"Name": name, "Email": email})
 		return
 	}
 
@@ -163,48 +186,57 @@ func RegisterSubmit(w http.ResponseWriter, r *http.Request) {
 	`, email, hash, name, time.Now()).Scan(&UserID)
 
 	if err != nil {
-		registerTmpl.Lookup("layout").Execute(w, PageData{
-			Flash:     fmt.Sprintf("Failed to create user: %v", err),
-			Form:      FormData{"Name": name, "Email": email},
-			CSRFToken: csrf.Token(r),
-			PageCSS:   "register",
-		})
+		flash := "Failed to create user, please try again later"
+		if database.IsUniqueViolation(err) {
+			flash = "An account with this email already exists"
+		} else {
+			slog.ErrorContext(r.Context(), "failed to create user", "error", err)
+		}
+		renderRegister(w, r, flash, FormData{"Name": name, "Email": email})
 		return
 	}
 
 	middleware.LogRegistration(r, email)
 
-	tokenString, err := utils.CreateJWT(UserID)
-	if err != nil {
+	if err := sendVerificationEmail(r.Context(), UserID, email); err != nil {
+		slog.ErrorContext(r.Context(), "failed to send verification email", "subject_id", UserID, "error", err)
+	}
+
+	if err := setAuthCookie(w, UserID, false); err != nil {
 		http.Error(w, "Error generation token", http.StatusInternalServerError)
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "auth_token",
-		Value:    tokenString,
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteStrictMode,
-		Path:     "/",
-		Expires:  time.Now().Add(24 * time.Hour),
-	})
-
+	views.AddFlash(w, r, views.InfoFlash("Check your inbox to confirm your email address"))
 	http.Redirect(w, r, "/profile", http.StatusSeeOther)
 }
 
-func LoginPage(w http.ResponseWriter, r *http.Request) {
+func renderRegister(w http.ResponseWriter, r *http.Request, message string, form FormData) {
+	registerTmpl.Render(w, r, &PageData{
+		Layout:  views.Layout{Flashes: []views.Flash{views.ErrorFlash(message)}},
+		Form:    form,
+		PageCSS: "register",
+	})
+}
+
+func renderLogin(w http.ResponseWriter, r *http.Request, flash views.Flash, form FormData) {
 	data := PageData{
-		CSRFToken: csrf.Token(r),
+		Form:      form,
 		PageCSS:   "login",
+		Providers: oidcProviderList,
 	}
-	if r.URL.Query().Get("registered") == "1" {
-		data.Flash = "Successfully registered. Enter email and password"
+	if flash.Message != "" {
+		data.Flashes = []views.Flash{flash}
 	}
-	err := loginTmpl.Lookup("layout").Execute(w, data)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Template error: %v", err), http.StatusInternalServerError)
+	loginTmpl.Render(w, r, &data)
+}
+
+func LoginPage(w http.ResponseWriter, r *http.Request) {
+	var flash views.Flash
+	if r.URL.Query().Get("registered") == "1" {
+		flash = views.SuccessFlash("Successfully registered. Enter email and password")
 	}
+	renderLogin(w, r, flash, nil)
 }
 
 func LoginSubmit(w http.ResponseWriter, r *http.Request) {
@@ -212,57 +244,83 @@ func LoginSubmit(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid form data", http.StatusBadRequest)
 		return
 	}
-	email := utils.SanitizeInput(r.FormValue("email"))
+	email := utils.NormalizeEmail(r.FormValue("email"))
 	password := r.FormValue("password")
 	remember := r.FormValue("remember") == "on"
 
 	if !utils.IsValidEmail(email) {
-		loginTmpl.Lookup("layout").Execute(w, PageData{
-			Flash:     "Invalid email format",
-			Form:      FormData{"Email": email},
-			CSRFToken: csrf.Token(r),
-			PageCSS:   "login",
-		})
+		renderLogin(w, r, views.ErrorFlash("Invalid email format"), FormData{"Email": email})
+		return
+	}
+
+	lockedUntil, err := loginLockedUntil(r, email)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !lockedUntil.IsZero() {
+		middleware.SecurityLogger("LOGIN_THROTTLED", r, 0, middleware.Metadata{"email": email})
+		renderLogin(w, r, views.ErrorFlash("Too many failed sign in attempts. Try again in "+formatRetryAfter(lockedUntil)), FormData{"Email": email})
 		return
 	}
 
 	var id int
 	var hash string
-	err := database.DB.QueryRow("SELECT id, password_hash FROM users WHERE email=$1", email).Scan(&id, &hash)
+	var totpEnabledAt *time.Time
+	err = database.DB.QueryRow("SELECT id, password_hash, totp_enabled_at FROM users WHERE email=$1", email).Scan(&id, &hash, &totpEnabledAt)
 	if err != nil {
-		middleware.LogFailedLogin(r, email)
-		loginTmpl.Lookup("layout").Execute(w, PageData{
-			Flash:     "Invalid email or password",
-			Form:      FormData{"Email": email},
-			CSRFToken: csrf.Token(r),
-		})
+		recordLoginFailure(r, email)
+		renderLogin(w, r, views.ErrorFlash("Invalid email or password"), FormData{"Email": email})
 		return
 	}
 
 	if !utils.CheckPasswordHash(password, hash) {
-		middleware.LogFailedLogin(r, email)
-		loginTmpl.Lookup("layout").Execute(w, PageData{
-			Flash:     "Invalid email or password",
-			Form:      FormData{"Email": email},
-			CSRFToken: csrf.Token(r),
-			PageCSS:   "login",
-		})
+		recordLoginFailure(r, email)
+		renderLogin(w, r, views.ErrorFlash("Invalid email or password"), FormData{"Email": email})
+		return
+	}
+
+	if totpEnabledAt != nil {
+		if err := setTwoFactorCookie(w, id, remember); err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
 		return
 	}
 
 	middleware.LogSuccessfulLogin(r, email)
+	clearLoginFailures(email)
 
-	tokenString, err := utils.CreateJWT(id)
-	if err != nil {
+	if err := setAuthCookie(w, id, remember); err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+func sessionVersion(userID int) (int, error) {
+	var version int
+	err := database.DB.QueryRow("SELECT session_version FROM users WHERE id = $1", userID).Scan(&version)
+	return version, err
+}
+
+func setAuthCookie(w http.ResponseWriter, userID int, remember bool) error {
+	version, err := sessionVersion(userID)
+	if err != nil {
+		return err
+	}
+	tokenString, err := utils.CreateJWT(userID, version)
+	if err != nil {
+		return err
+	}
+
 	cookie := &http.Cookie{
 		Name:     "auth_token",
 		Value:    tokenString,
 		HttpOnly: true,
-		Secure:   true,
+		Secure:   middleware.SecureCookies(),
 		SameSite: http.SameSiteStrictMode,
 		Path:     "/",
 	}
@@ -272,6 +330,5 @@ func LoginSubmit(w http.ResponseWriter, r *http.Request) {
 		cookie.Expires = time.Now().Add(24 * time.Hour)
 	}
 	http.SetCookie(w, cookie)
-
-	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+	return nil
 }
@@ -1,11 +1,14 @@
 package auth
 
 import (
-	"fmt"
+	"log/slog"
 	"net/http"
 
 	"example.com/m/v2/internal/database"
+	"example.com/m/v2/internal/metrics"
+	"example.com/m/v2/internal/middleware"
 	"example.com/m/v2/internal/services"
+	"example.com/m/v2/internal/views"
 )
 
 func UploadAvatarHandler(w http.ResponseWriter, r *http.Request) {
@@ -15,29 +18,31 @@ func UploadAvatarHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmt.Printf("Avatar upload request from user %v\n", userID)
-
 	err := r.ParseMultipartForm(10 << 20)
 	if err != nil {
-		fmt.Printf("Error parsing form: %v\n", err)
-		http.Redirect(w, r, "/profile?flash=File+too+large", http.StatusSeeOther)
+		slog.WarnContext(r.Context(), "failed to parse avatar upload", "error", err)
+		views.AddFlash(w, r, views.ErrorFlash("File too large"))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
 		return
 	}
 
 	file, header, err := r.FormFile("avatar")
 	if err != nil {
-		fmt.Printf("Error getting file from form: %v\n", err)
-		http.Redirect(w, r, "/profile?flash=Error+uploading+file", http.StatusSeeOther)
+		slog.WarnContext(r.Context(), "avatar upload has no file", "error", err)
+		views.AddFlash(w, r, views.ErrorFlash("Error uploading file"))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
 		return
 	}
 	defer file.Close()
 
-	fmt.Printf("Received file: %s (size: %d bytes)\n", header.Filename, header.Size)
+	slog.DebugContext(r.Context(), "avatar received", "filename", header.Filename, "size", header.Size)
 
-	avatarURL, err := services.UploadAvatar(file, userID.(int))
+	avatarURL, err := services.UploadAvatar(r.Context(), file, userID.(int))
+	metrics.AvatarUploads.WithLabelValues(metrics.Outcome(err)).Inc()
 	if err != nil {
-		fmt.Printf("Error uploading to Cloudinary: %v\n", err)
-		http.Redirect(w, r, fmt.Sprintf("/profile?flash=Upload+failed:+%v", err), http.StatusSeeOther)
+		slog.ErrorContext(r.Context(), "failed to store avatar", "error", err)
+		views.AddFlash(w, r, views.ErrorFlash("Upload failed, please try again"))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
 		return
 	}
 
@@ -48,11 +53,13 @@ func UploadAvatarHandler(w http.ResponseWriter, r *http.Request) {
 	`, avatarURL, userID)
 
 	if err != nil {
-		fmt.Printf("Error saving avatar URL to database: %v\n", err)
-		http.Redirect(w, r, "/profile?flash=Error+saving+avatar", http.StatusSeeOther)
+		slog.ErrorContext(r.Context(), "failed to save avatar URL", "error", err)
+		views.AddFlash(w, r, views.ErrorFlash("Error saving avatar"))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
 		return
 	}
 
-	fmt.Printf("— Avatar updated successfully for user %v\n", userID)
-	http.Redirect(w, r, "/profile?flash=Avatar+updated+successfully", http.StatusSeeOther)
+	middleware.SecurityLogger("AVATAR_CHANGED", r, userID.(int), middleware.Metadata{"avatar_url": avatarURL})
+	views.AddFlash(w, r, views.SuccessFlash("Avatar updated successfully"))
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
 }
@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"example.com/m/v2/internal/database"
+	"example.com/m/v2/internal/middleware"
+	"example.com/m/v2/internal/services"
+)
+
+type throttlePolicy struct {
+	prefix        string
+	backoffAfter  int
+	lockoutAfter  int
+	maxDelay      time.Duration
+	lockoutPeriod time.Duration
+}
+
+var (
+	accountThrottle = throttlePolicy{
+		prefix:        "account:",
+		backoffAfter:  3,
+		lockoutAfter:  10,
+		maxDelay:      5 * time.Minute,
+		lockoutPeriod: 30 * time.Minute,
+	}
+	ipThrottle = throttlePolicy{
+		prefix:        "ip:",
+		backoffAfter:  10,
+		lockoutAfter:  50,
+		maxDelay:      5 * time.Minute,
+		lockoutPeriod: time.Hour,
+	}
+)
+
+// throttleRetention is how long a counter lives after the last failure.
+// Failures older than that start the count over, so the row is useless.
+const throttleRetention = 24 * time.Hour
+
+func accountThrottleKey(email string) string {
+	return accountThrottle.prefix + strings.ToLower(email)
+}
+
+func ipThrottleKey(r *http.Request) string {
+	return ipThrottle.prefix + middleware.ClientIP(r)
+}
+
+func (p throttlePolicy) delay(failures int) time.Duration {
+	if failures >= p.lockoutAfter {
+		return p.lockoutPeriod
+	}
+	if failures < p.backoffAfter {
+		return 0
+	}
+	d := time.Duration(math.Pow(2, float64(failures-p.backoffAfter))) * time.Second
+	if d > p.maxDelay {
+		d = p.maxDelay
+	}
+	return d
+}
+
+func loginLockedUntil(r *http.Request, email string) (time.Time, error) {
+	var lockedUntil sql.NullTime
+	err := database.DB.QueryRow(`
+		SELECT MAX(locked_until)
+		FROM login_throttles
+		WHERE key IN ($1, $2) AND locked_until > now()
+	`, accountThrottleKey(email), ipThrottleKey(r)).Scan(&lockedUntil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !lockedUntil.Valid {
+		return time.Time{}, nil
+	}
+	return lockedUntil.Time, nil
+}
+
+func recordThrottleFailure(key string, p throttlePolicy) (int, error) {
+	var failures int
+	err := database.DB.QueryRow(`
+		INSERT INTO login_throttles (key, failures, last_failure_at)
+		VALUES ($1, 1, now())
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE
+				WHEN login_throttles.last_failure_at < now() - make_interval(secs => $2) THEN 1
+				ELSE login_throttles.failures + 1
+			END,
+			last_failure_at = now()
+		RETURNING failures
+	`, key, throttleRetention.Seconds()).Scan(&failures)
+	if err != nil {
+		return 0, err
+	}
+
+	if d := p.delay(failures); d > 0 {
+		_, err = database.DB.Exec(`
+			UPDATE login_throttles SET locked_until = now() + make_interval(secs => $2) WHERE key = $1
+		`, key, d.Seconds())
+	}
+	return failures, err
+}
+
+func recordLoginFailure(r *http.Request, email string) {
+	middleware.LogFailedLogin(r, email)
+
+	if _, err := recordThrottleFailure(ipThrottleKey(r), ipThrottle); err != nil {
+		slog.ErrorContext(r.Context(), "failed to record failed login for IP", "error", err)
+	}
+
+	failures, err := recordThrottleFailure(accountThrottleKey(email), accountThrottle)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to record failed login for account", "error", err)
+		return
+	}
+
+	if failures == accountThrottle.lockoutAfter {
+		middleware.SecurityLogger("ACCOUNT_LOCKED", r, 0, middleware.Metadata{"email": email, "failures": failures})
+		go notifyAccountLocked(context.WithoutCancel(r.Context()), email, failures)
+	}
+}
+
+func clearLoginFailures(email string) {
+	if _, err := database.DB.Exec("DELETE FROM login_throttles WHERE key = $1", accountThrottleKey(email)); err != nil {
+		slog.Error("failed to clear failed logins", "error", err)
+	}
+}
+
+// expireLoginThrottles deletes counters that have outlived
+// throttleRetention. Most of them belong to emails without an account, which
+// a successful login never clears.
+func expireLoginThrottles() {
+	res, err := database.DB.Exec(`
+		DELETE FROM login_throttles
+		WHERE last_failure_at < now() - make_interval(secs => $1)
+			AND (locked_until IS NULL OR locked_until < now())
+	`, throttleRetention.Seconds())
+	if err != nil {
+		slog.Error("failed to expire login throttles", "error", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		slog.Info("expired login throttles", "count", n)
+	}
+}
+
+func notifyAccountLocked(ctx context.Context, email string, failures int) {
+	var exists bool
+	if err := database.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)", email).Scan(&exists); err != nil || !exists {
+		return
+	}
+
+	body := fmt.Sprintf(
+		"Hello!\n\nWe noticed %d failed attempts to sign in to your account, so signing in has been "+
+			"temporarily blocked for %d minutes.\n\nIf this was not you, we recommend changing your password "+
+			"once you are able to sign in again.\n",
+		failures, int(accountThrottle.lockoutPeriod.Minutes()),
+	)
+	if err := services.SendEmail(ctx, email, "Your account has been temporarily locked", body); err != nil {
+		slog.ErrorContext(ctx, "failed to send lockout notification", "email", email, "error", err)
+	}
+}
+
+func formatRetryAfter(until time.Time) string {
+	d := time.Until(until).Round(time.Second)
+	if d < time.Minute {
+		return fmt.Sprintf("%d seconds", int(d.Seconds())+1)
+	}
+	return fmt.Sprintf("%d minutes", int(math.Ceil(d.Minutes())))
+}
@@ -2,15 +2,14 @@ package auth
 
 import (
 	"context"
-	"fmt"
 	"net/http"
-	"os"
 
-	"github.com/golang-jwt/jwt/v5"
+	"example.com/m/v2/internal/database"
+	"example.com/m/v2/internal/logging"
+	"example.com/m/v2/internal/utils"
+	"example.com/m/v2/internal/views"
 )
 
-var secret = []byte(os.Getenv("JWT_SECRET"))
-
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		cookie, err := r.Cookie("auth_token")
@@ -19,22 +18,70 @@ func AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		tokenStr := cookie.Value
-		token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return secret, nil
-		})
-		if err != nil || !token.Valid {
+		claims, err := utils.ParseJWT(cookie.Value)
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		if _, scoped := claims["purpose"]; scoped {
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
 			return
 		}
 
-		claims := token.Claims.(jwt.MapClaims)
 		userID := int(claims["sub"].(float64))
+		// Tokens from before session versions carry no "ver" and count as 0.
+		tokenVersion, _ := claims["ver"].(float64)
+		version, err := sessionVersion(userID)
+		if err != nil || int(tokenVersion) != version {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		logging.SetUserID(r.Context(), userID)
 		ctx := context.WithValue(r.Context(), "userID", userID)
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+func RequireVerifiedEmail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("userID")
+		if userID == nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		verified, err := isEmailVerified(userID)
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if !verified {
+			views.AddFlash(w, r, views.InfoFlash("Please verify your email address first"))
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("userID")
+		if userID == nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		var role string
+		err := database.DB.QueryRow("SELECT COALESCE(role, 'user') FROM users WHERE id = $1", userID).Scan(&role)
+		if err != nil || role != "admin" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,335 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+
+	"example.com/m/v2/internal/config"
+	"example.com/m/v2/internal/database"
+	"example.com/m/v2/internal/middleware"
+	"example.com/m/v2/internal/utils"
+	"example.com/m/v2/internal/views"
+)
+
+var redirectTmpl = views.Must("layout.html", "redirect.html")
+
+const oidcStateCookie = "oidc_state"
+
+type OIDCProvider struct {
+	Name        string
+	DisplayName string
+	verifier    *oidc.IDTokenVerifier
+	config      oauth2.Config
+}
+
+type oidcClaims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	AuthTime      int64  `json:"auth_time"`
+}
+
+var oidcProviders = map[string]*OIDCProvider{}
+var oidcProviderList []*OIDCProvider
+
+func InitOIDCProviders(ctx context.Context, providers []config.OIDCProvider) error {
+	for _, cfg := range providers {
+		name := cfg.Name
+		if cfg.Issuer == "" || cfg.ClientID == "" {
+			return fmt.Errorf("OIDC provider %q requires an issuer and a client ID", name)
+		}
+
+		provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+		if err != nil {
+			slog.Warn("OIDC provider unavailable, skipping", "provider", name, "error", err)
+			continue
+		}
+
+		p := &OIDCProvider{
+			Name:        name,
+			DisplayName: cfg.DisplayName,
+			verifier:    provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+			config: oauth2.Config{
+				ClientID:     cfg.ClientID,
+				ClientSecret: cfg.ClientSecret,
+				Endpoint:     provider.Endpoint(),
+				RedirectURL:  fmt.Sprintf("%s/auth/oidc/%s/callback", getAppBaseURL(), name),
+				Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+			},
+		}
+		oidcProviders[name] = p
+		oidcProviderList = append(oidcProviderList, p)
+		slog.Info("OIDC provider initialized", "provider", name, "issuer", cfg.Issuer)
+	}
+	return nil
+}
+
+func OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := oidcProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	startOIDC(w, r, p, 0)
+}
+
+// startOIDC redirects to the provider. With reauthUserID set the provider is
+// asked to prompt for credentials again instead of reusing its session.
+func startOIDC(w http.ResponseWriter, r *http.Request, p *OIDCProvider, reauthUserID int) {
+	state, err := utils.GenerateToken(32)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := utils.GenerateToken(32)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	stateToken, err := utils.CreateOIDCStateJWT(p.Name, state, nonce, verifier, reauthUserID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Lax rather than Strict: the callback is a cross-site navigation from the IdP.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    stateToken,
+		Path:     "/auth/oidc",
+		HttpOnly: true,
+		Secure:   middleware.SecureCookies(),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   600,
+	})
+
+	opts := []oauth2.AuthCodeOption{oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)}
+	if reauthUserID != 0 {
+		opts = append(opts, oauth2.SetAuthURLParam("prompt", "login"), oauth2.SetAuthURLParam("max_age", "0"))
+	}
+	http.Redirect(w, r, p.config.AuthCodeURL(state, opts...), http.StatusFound)
+}
+
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := oidcProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		renderLogin(w, r, views.ErrorFlash("Sign in session expired, please try again"), nil)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    "",
+		Path:     "/auth/oidc",
+		HttpOnly: true,
+		Secure:   middleware.SecureCookies(),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	})
+
+	claims, err := utils.ParseJWT(cookie.Value)
+	if err != nil || claims["purpose"] != "oidc" || claims["provider"] != p.Name {
+		renderLogin(w, r, views.ErrorFlash("Sign in session expired, please try again"), nil)
+		return
+	}
+
+	expectedState, _ := claims["state"].(string)
+	if subtle.ConstantTimeCompare([]byte(expectedState), []byte(r.URL.Query().Get("state"))) != 1 {
+		middleware.SecurityLogger("OIDC_STATE_MISMATCH", r, 0, middleware.Metadata{"provider": p.Name})
+		renderLogin(w, r, views.ErrorFlash("Sign in failed, please try again"), nil)
+		return
+	}
+
+	if errCode := r.URL.Query().Get("error"); errCode != "" {
+		slog.InfoContext(r.Context(), "OIDC provider returned error", "provider", p.Name, "error", errCode)
+		renderLogin(w, r, views.ErrorFlash("Sign in was cancelled or denied"), nil)
+		return
+	}
+
+	verifier, _ := claims["verifier"].(string)
+	oauthToken, err := p.config.Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		slog.WarnContext(r.Context(), "OIDC code exchange failed", "provider", p.Name, "error", err)
+		renderLogin(w, r, views.ErrorFlash("Sign in failed, please try again"), nil)
+		return
+	}
+
+	rawIDToken, ok := oauthToken.Extra("id_token").(string)
+	if !ok {
+		renderLogin(w, r, views.ErrorFlash("Sign in failed, please try again"), nil)
+		return
+	}
+
+	idToken, err := p.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil {
+		slog.WarnContext(r.Context(), "OIDC ID token rejected", "provider", p.Name, "error", err)
+		renderLogin(w, r, views.ErrorFlash("Sign in failed, please try again"), nil)
+		return
+	}
+
+	expectedNonce, _ := claims["nonce"].(string)
+	if subtle.ConstantTimeCompare([]byte(expectedNonce), []byte(idToken.Nonce)) != 1 {
+		middleware.SecurityLogger("OIDC_NONCE_MISMATCH", r, 0, middleware.Metadata{"provider": p.Name})
+		renderLogin(w, r, views.ErrorFlash("Sign in failed, please try again"), nil)
+		return
+	}
+
+	var idClaims oidcClaims
+	if err := idToken.Claims(&idClaims); err != nil {
+		renderLogin(w, r, views.ErrorFlash("Sign in failed, please try again"), nil)
+		return
+	}
+
+	if reauthUserID, ok := claims["reauth"].(float64); ok {
+		finishReauth(w, r, p, int(reauthUserID), idClaims)
+		return
+	}
+
+	userID, err := findOrCreateOIDCUser(r.Context(), p.Name, idClaims)
+	if err != nil {
+		if errors.Is(err, errUnverifiedOIDCEmail) {
+			renderLogin(w, r, views.ErrorFlash(fmt.Sprintf("%s did not confirm your email address", p.DisplayName)), nil)
+			return
+		}
+		slog.ErrorContext(r.Context(), "OIDC login failed", "provider", p.Name, "error", err)
+		renderLogin(w, r, views.ErrorFlash("Sign in failed, please try again"), nil)
+		return
+	}
+
+	var totpEnabledAt *time.Time
+	if err := database.DB.QueryRow("SELECT totp_enabled_at FROM users WHERE id = $1", userID).Scan(&totpEnabledAt); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	next := "/profile"
+	if totpEnabledAt != nil {
+		err = setTwoFactorCookie(w, userID, false)
+		next = "/login/2fa"
+	} else {
+		middleware.LogSuccessfulLogin(r, idClaims.Email)
+		err = setAuthCookie(w, userID, false)
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// A plain redirect would still count as cross-site for SameSite=Strict
+	// cookies, so finish the login with a same-site navigation.
+	redirectTmpl.Render(w, r, &PageData{
+		PageCSS: "login",
+		Data:    next,
+	})
+}
+
+var errUnverifiedOIDCEmail = errors.New("identity provider did not return a verified email")
+
+func findOrCreateOIDCUser(ctx context.Context, provider string, claims oidcClaims) (int, error) {
+	claims.Email = utils.NormalizeEmail(claims.Email)
+
+	var userID int
+	err := database.DB.QueryRow(`
+		UPDATE user_identities
+		SET last_login_at = now(), email = $3
+		WHERE provider = $1 AND subject = $2
+		RETURNING user_id
+	`, provider, claims.Subject, claims.Email).Scan(&userID)
+	if err == nil {
+		return userID, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified || !utils.IsValidEmail(claims.Email) {
+		return 0, errUnverifiedOIDCEmail
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var verified bool
+	err = tx.QueryRow(
+		"SELECT id, email_verified_at IS NOT NULL FROM users WHERE email = $1 FOR UPDATE", claims.Email,
+	).Scan(&userID, &verified)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		name := utils.SanitizeInput(claims.Name)
+		err = tx.QueryRow(`
+			INSERT INTO users (email, password_hash, name, created_at, email_verified_at)
+			VALUES ($1, '', $2, now(), now())
+			RETURNING id
+		`, claims.Email, name).Scan(&userID)
+	case err == nil && !verified:
+		err = takeOverUnverifiedAccount(tx, userID)
+		if err == nil {
+			slog.WarnContext(ctx, "unverified account taken over by OIDC sign in", "provider", provider, "subject_id", userID)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO user_identities (user_id, provider, subject, email, last_login_at)
+		VALUES ($1, $2, $3, $4, now())
+	`, userID, provider, claims.Subject, claims.Email)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	slog.InfoContext(ctx, "OIDC identity linked", "provider", provider, "subject_id", userID, "email", claims.Email)
+	return userID, nil
+}
+
+// takeOverUnverifiedAccount hands an account whose email was never confirmed
+// to the person the provider vouches for. Anyone could have registered it
+// with that address, so the password, second factor, API tokens, pending
+// email changes and sessions its creator set up are all dropped.
+func takeOverUnverifiedAccount(tx *sql.Tx, userID int) error {
+	_, err := tx.Exec(`
+		UPDATE users
+		SET password_hash = '', totp_secret = NULL, totp_enabled_at = NULL, totp_last_counter = NULL,
+			deletion_requested_at = NULL, email_verified_at = now(), session_version = session_version + 1
+		WHERE id = $1
+	`, userID)
+	if err != nil {
+		return err
+	}
+	for _, query := range []string{
+		"DELETE FROM user_recovery_codes WHERE user_id = $1",
+		"DELETE FROM email_verifications WHERE user_id = $1",
+		"UPDATE api_tokens SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL",
+	} {
+		if _, err := tx.Exec(query, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,561 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+
+	"example.com/m/v2/internal/config"
+	"example.com/m/v2/internal/database"
+	"example.com/m/v2/internal/migrate"
+	"example.com/m/v2/internal/utils"
+	"example.com/m/v2/migrations"
+)
+
+// haveDB is set when TEST_DATABASE_URL points at a Postgres database the
+// tests may migrate and write to.
+var haveDB bool
+
+func TestMain(m *testing.M) {
+	if err := utils.InitJWTKeys(config.JWT{Secret: "test-secret-that-is-long-enough-for-hs256"}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		// Nothing listens here: audit writes fail fast and are only logged.
+		dsn = "host=127.0.0.1 port=1 sslmode=disable connect_timeout=1"
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	database.DB = db
+
+	if os.Getenv("TEST_DATABASE_URL") != "" {
+		migrator, err := migrate.New(db, migrations.FS)
+		if err == nil {
+			_, err = migrator.Up(context.Background())
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "migrating test database:", err)
+			os.Exit(1)
+		}
+		haveDB = true
+	}
+
+	os.Exit(m.Run())
+}
+
+func requireDB(t *testing.T) {
+	t.Helper()
+	if !haveDB {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+}
+
+// mockIdP is a minimal OpenID provider: discovery, JWKS and a token endpoint
+// that checks PKCE. The authorization step is simulated by authorize.
+type mockIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu      sync.Mutex
+	pending map[string]pendingCode
+	// exchanges counts token requests, failed ones and the oauth2 client's
+	// retry with another auth style included.
+	exchanges int
+}
+
+type pendingCode struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key, pending: map[string]pendingCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// authorize plays the user signing in at the provider: it reads the nonce
+// and PKCE challenge from the authorization URL and returns a code that
+// yields an ID token with claims.
+func (idp *mockIdP) authorize(t *testing.T, authURL string, claims jwt.MapClaims) string {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("authorization URL has no S256 PKCE challenge: %s", authURL)
+	}
+	if _, ok := claims["nonce"]; !ok {
+		claims["nonce"] = q.Get("nonce")
+	}
+
+	code, err := utils.GenerateToken(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.mu.Lock()
+	idp.pending[code] = pendingCode{challenge: q.Get("code_challenge"), claims: claims}
+	idp.mu.Unlock()
+	return code
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.exchanges++
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pending, ok := idp.pending[r.PostForm.Get("code")]
+	delete(idp.pending, r.PostForm.Get("code"))
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != pending.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss": idp.URL,
+		"aud": "books",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Minute).Unix(),
+	}
+	for k, v := range pending.claims {
+		claims[k] = v
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test"
+	idToken, err := token.SignedString(idp.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     idToken,
+	})
+}
+
+func setupOIDC(t *testing.T) *mockIdP {
+	t.Helper()
+	idp := newMockIdP(t)
+
+	oidcProviders = map[string]*OIDCProvider{}
+	oidcProviderList = nil
+	err := InitOIDCProviders(context.Background(), []config.OIDCProvider{{
+		Name:         "mock",
+		DisplayName:  "Mock",
+		Issuer:       idp.URL,
+		ClientID:     "books",
+		ClientSecret: "secret",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := oidcProviders["mock"]; !ok {
+		t.Fatal("mock provider was not registered")
+	}
+	return idp
+}
+
+// startLogin runs OIDCLoginHandler and returns the authorization URL and the
+// state cookie it set.
+func startLogin(t *testing.T) (string, *http.Cookie) {
+	t.Helper()
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/auth/oidc/mock", nil), map[string]string{"provider": "mock"})
+	rec := httptest.NewRecorder()
+	OIDCLoginHandler(rec, req)
+
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login status = %d, want %d", rec.Code, http.StatusFound)
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			return rec.Header().Get("Location"), c
+		}
+	}
+	t.Fatal("no state cookie set")
+	return "", nil
+}
+
+func callback(state, code string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	target := "/auth/oidc/mock/callback?" + url.Values{"state": {state}, "code": {code}}.Encode()
+	req := mux.SetURLVars(httptest.NewRequest("GET", target, nil), map[string]string{"provider": "mock"})
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	OIDCCallbackHandler(rec, req)
+	return rec
+}
+
+func stateOf(t *testing.T, authURL string) string {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query().Get("state")
+}
+
+func authCookie(rec *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "auth_token" && c.Value != "" {
+			return c
+		}
+	}
+	return nil
+}
+
+func assertRejected(t *testing.T, rec *httptest.ResponseRecorder, message string) {
+	t.Helper()
+	if c := authCookie(rec); c != nil {
+		t.Errorf("rejected callback set an auth cookie")
+	}
+	if !strings.Contains(rec.Body.String(), message) {
+		t.Errorf("body does not contain %q:\n%s", message, rec.Body.String())
+	}
+}
+
+func TestOIDCLoginRedirect(t *testing.T) {
+	idp := setupOIDC(t)
+	authURL, cookie := startLogin(t)
+
+	if !strings.HasPrefix(authURL, idp.URL+"/authorize?") {
+		t.Fatalf("redirect = %s, want the provider's authorization endpoint", authURL)
+	}
+	u, _ := url.Parse(authURL)
+	q := u.Query()
+	for _, param := range []string{"state", "nonce", "code_challenge"} {
+		if q.Get(param) == "" {
+			t.Errorf("authorization URL has no %s", param)
+		}
+	}
+	if q.Get("prompt") != "" {
+		t.Errorf("plain login asks for prompt=%s", q.Get("prompt"))
+	}
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Path != "/auth/oidc" {
+		t.Errorf("state cookie = %+v", cookie)
+	}
+
+	claims, err := utils.ParseJWT(cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["state"] != q.Get("state") || claims["nonce"] != q.Get("nonce") {
+		t.Errorf("state cookie does not match the authorization URL")
+	}
+	verifier, _ := claims["verifier"].(string)
+	sum := sha256.Sum256([]byte(verifier))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != q.Get("code_challenge") {
+		t.Errorf("code challenge is not the S256 hash of the stored verifier")
+	}
+}
+
+func TestOIDCCallbackRejectsMissingStateCookie(t *testing.T) {
+	idp := setupOIDC(t)
+	authURL, _ := startLogin(t)
+	code := idp.authorize(t, authURL, jwt.MapClaims{"sub": "u1", "email": "a@example.com", "email_verified": true})
+
+	rec := callback(stateOf(t, authURL), code, nil)
+	assertRejected(t, rec, "Sign in session expired")
+	if idp.exchanges != 0 {
+		t.Errorf("code was exchanged without a state cookie")
+	}
+}
+
+func TestOIDCCallbackRejectsStateMismatch(t *testing.T) {
+	idp := setupOIDC(t)
+	authURL, cookie := startLogin(t)
+	code := idp.authorize(t, authURL, jwt.MapClaims{"sub": "u1", "email": "a@example.com", "email_verified": true})
+
+	rec := callback("forged-state", code, cookie)
+	assertRejected(t, rec, "Sign in failed")
+	if idp.exchanges != 0 {
+		t.Errorf("code was exchanged despite a state mismatch")
+	}
+}
+
+func TestOIDCCallbackRejectsStateForOtherProvider(t *testing.T) {
+	setupOIDC(t)
+	token, err := utils.CreateOIDCStateJWT("other", "state", "nonce", "verifier", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := callback("state", "code", &http.Cookie{Name: oidcStateCookie, Value: token})
+	assertRejected(t, rec, "Sign in session expired")
+}
+
+func TestOIDCCallbackRejectsWrongPKCEVerifier(t *testing.T) {
+	idp := setupOIDC(t)
+	authURL, _ := startLogin(t)
+	code := idp.authorize(t, authURL, jwt.MapClaims{"sub": "u1", "email": "a@example.com", "email_verified": true})
+
+	// A state cookie for the same state and nonce but another verifier, as
+	// an attacker who intercepted the code would have.
+	u, _ := url.Parse(authURL)
+	forged, err := utils.CreateOIDCStateJWT("mock", u.Query().Get("state"), u.Query().Get("nonce"), "attacker-verifier", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := callback(stateOf(t, authURL), code, &http.Cookie{Name: oidcStateCookie, Value: forged})
+	assertRejected(t, rec, "Sign in failed")
+	if idp.exchanges == 0 {
+		t.Errorf("callback never reached the token endpoint")
+	}
+}
+
+func TestOIDCCallbackRejectsNonceMismatch(t *testing.T) {
+	idp := setupOIDC(t)
+	authURL, cookie := startLogin(t)
+	code := idp.authorize(t, authURL, jwt.MapClaims{
+		"sub":            "u1",
+		"email":          "a@example.com",
+		"email_verified": true,
+		"nonce":          "replayed-nonce",
+	})
+
+	rec := callback(stateOf(t, authURL), code, cookie)
+	assertRejected(t, rec, "Sign in failed")
+}
+
+func TestOIDCCallbackRejectsTokenFromOtherIssuer(t *testing.T) {
+	idp := setupOIDC(t)
+	authURL, cookie := startLogin(t)
+	code := idp.authorize(t, authURL, jwt.MapClaims{
+		"sub":            "u1",
+		"email":          "a@example.com",
+		"email_verified": true,
+		"iss":            "https://evil.example.com",
+	})
+
+	rec := callback(stateOf(t, authURL), code, cookie)
+	assertRejected(t, rec, "Sign in failed")
+}
+
+// uniqueEmail keeps test users apart from each other and from earlier runs.
+func uniqueEmail(t *testing.T) string {
+	t.Helper()
+	suffix, err := utils.GenerateToken(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.ToLower(fmt.Sprintf("oidc-%s@example.com", strings.Trim(suffix, "-_")))
+}
+
+func deleteUser(t *testing.T, email string) {
+	t.Cleanup(func() {
+		database.DB.Exec("DELETE FROM users WHERE email = $1", email)
+	})
+}
+
+func TestOIDCCallbackCreatesUser(t *testing.T) {
+	requireDB(t)
+	idp := setupOIDC(t)
+	email := uniqueEmail(t)
+	deleteUser(t, email)
+
+	authURL, cookie := startLogin(t)
+	code := idp.authorize(t, authURL, jwt.MapClaims{"sub": email, "email": email, "email_verified": true, "name": "New User"})
+	rec := callback(stateOf(t, authURL), code, cookie)
+
+	if authCookie(rec) == nil {
+		t.Fatalf("no auth cookie after a valid callback:\n%s", rec.Body.String())
+	}
+	var hash string
+	var verified bool
+	err := database.DB.QueryRow(
+		"SELECT password_hash, email_verified_at IS NOT NULL FROM users WHERE email = $1", email,
+	).Scan(&hash, &verified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != "" || !verified {
+		t.Errorf("new user: password_hash = %q, verified = %v; want passwordless and verified", hash, verified)
+	}
+}
+
+func TestFindOrCreateOIDCUserLinksExistingEmail(t *testing.T) {
+	requireDB(t)
+	email := uniqueEmail(t)
+	deleteUser(t, email)
+
+	var existingID int
+	err := database.DB.QueryRow(`
+		INSERT INTO users (email, password_hash, name, created_at, email_verified_at)
+		VALUES ($1, 'hash', 'Existing', now(), now())
+		RETURNING id
+	`, email).Scan(&existingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID, err := findOrCreateOIDCUser(context.Background(), "mock", oidcClaims{Subject: email, Email: email, EmailVerified: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != existingID {
+		t.Fatalf("linked to user %d, want existing user %d", userID, existingID)
+	}
+
+	var hash string
+	if err := database.DB.QueryRow("SELECT password_hash FROM users WHERE id = $1", userID).Scan(&hash); err != nil {
+		t.Fatal(err)
+	}
+	if hash != "hash" {
+		t.Errorf("linking to a verified account changed its password to %q", hash)
+	}
+
+	// The identity is found by subject from now on, whatever the email.
+	again, err := findOrCreateOIDCUser(context.Background(), "mock", oidcClaims{Subject: email, Email: "changed@example.com"})
+	if err != nil || again != existingID {
+		t.Errorf("second login = %d, %v; want %d", again, err, existingID)
+	}
+}
+
+func TestFindOrCreateOIDCUserTakesOverUnverifiedAccount(t *testing.T) {
+	requireDB(t)
+	email := uniqueEmail(t)
+	deleteUser(t, email)
+
+	// Someone registered the address first and never confirmed it.
+	var existingID int
+	err := database.DB.QueryRow(`
+		INSERT INTO users (email, password_hash, name, created_at, totp_secret, totp_enabled_at)
+		VALUES ($1, 'attacker-hash', 'Squatter', now(), 'secret', now())
+		RETURNING id
+	`, email).Scan(&existingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = database.DB.Exec(
+		"INSERT INTO api_tokens (user_id, name, token_hash) VALUES ($1, 'squatter', $2)", existingID, email,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID, err := findOrCreateOIDCUser(context.Background(), "mock", oidcClaims{Subject: email, Email: email, EmailVerified: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != existingID {
+		t.Fatalf("linked to user %d, want existing user %d", userID, existingID)
+	}
+
+	var hash string
+	var verified, totp bool
+	var version, activeTokens int
+	err = database.DB.QueryRow(`
+		SELECT password_hash, email_verified_at IS NOT NULL, totp_enabled_at IS NOT NULL, session_version,
+			(SELECT COUNT(*) FROM api_tokens WHERE user_id = users.id AND revoked_at IS NULL)
+		FROM users WHERE id = $1
+	`, userID).Scan(&hash, &verified, &totp, &version, &activeTokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != "" || totp || activeTokens != 0 {
+		t.Errorf("squatter credentials survived: password_hash = %q, 2FA = %v, active tokens = %d", hash, totp, activeTokens)
+	}
+	if !verified || version != 1 {
+		t.Errorf("verified = %v, session_version = %d; want verified and existing sessions ended", verified, version)
+	}
+}
+
+func TestOIDCCallbackRejectsUnverifiedEmail(t *testing.T) {
+	requireDB(t)
+	idp := setupOIDC(t)
+	email := uniqueEmail(t)
+	deleteUser(t, email)
+
+	var existingID int
+	err := database.DB.QueryRow(`
+		INSERT INTO users (email, password_hash, name, created_at)
+		VALUES ($1, 'hash', 'Existing', now())
+		RETURNING id
+	`, email).Scan(&existingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, cookie := startLogin(t)
+	code := idp.authorize(t, authURL, jwt.MapClaims{"sub": email, "email": email, "email_verified": false})
+	rec := callback(stateOf(t, authURL), code, cookie)
+
+	assertRejected(t, rec, "Mock did not confirm your email address")
+	var linked bool
+	err = database.DB.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM user_identities WHERE provider = 'mock' AND subject = $1)", email,
+	).Scan(&linked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linked {
+		t.Errorf("an unverified email was linked to an existing account")
+	}
+}
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"example.com/m/v2/internal/database"
+	"example.com/m/v2/internal/middleware"
+	"example.com/m/v2/internal/services"
+	"example.com/m/v2/internal/utils"
+	"example.com/m/v2/internal/views"
+)
+
+func UpdateNameHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID")
+	if userID == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	name := utils.SanitizeInput(r.FormValue("name"))
+	if len(name) < 2 || len(name) > 100 {
+		views.AddFlash(w, r, views.ErrorFlash("Name must be between 2 and 100 characters"))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	if _, err := database.DB.Exec("UPDATE users SET name = $1 WHERE id = $2", name, userID); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	views.AddFlash(w, r, views.SuccessFlash("Name updated"))
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+func UpdateEmailHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID")
+	if userID == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	email := utils.NormalizeEmail(r.FormValue("email"))
+	if !utils.IsValidEmail(email) {
+		views.AddFlash(w, r, views.ErrorFlash("Invalid email format"))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	ok, err := confirmIdentity(r, userID.(int), true)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		views.AddFlash(w, r, views.ErrorFlash(reauthFailedMessage))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	var currentEmail string
+	var taken bool
+	err = database.DB.QueryRow(`
+		SELECT email, EXISTS(SELECT 1 FROM users WHERE email = $2 AND id <> $1)
+		FROM users
+		WHERE id = $1
+	`, userID, email).Scan(&currentEmail, &taken)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if currentEmail == email {
+		views.AddFlash(w, r, views.ErrorFlash("This is already your email address"))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+	if taken {
+		views.AddFlash(w, r, views.ErrorFlash("This email address is already in use"))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	if err := checkVerificationRateLimit(userID.(int)); err != nil {
+		if errors.Is(err, errVerificationRateLimited) {
+			views.AddFlash(w, r, views.ErrorFlash("Please wait before requesting another email"))
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			return
+		}
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := sendVerificationEmail(r.Context(), userID.(int), email); err != nil {
+		slog.ErrorContext(r.Context(), "failed to send email change confirmation", "error", err)
+		views.AddFlash(w, r, views.ErrorFlash("Could not send confirmation email"))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	middleware.SecurityLogger("EMAIL_CHANGE_REQUESTED", r, userID.(int), middleware.Metadata{"from": currentEmail, "to": email})
+	views.AddFlash(w, r, views.InfoFlash("We sent a confirmation link to your new email address"))
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+func UpdatePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID")
+	if userID == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	password := r.FormValue("password")
+	if password != r.FormValue("password_confirm") {
+		views.AddFlash(w, r, views.ErrorFlash("Passwords don't match"))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+	if len(password) < 8 {
+		views.AddFlash(w, r, views.ErrorFlash("The password must contain at least 8 characters"))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	ok, err := confirmIdentity(r, userID.(int), true)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		middleware.SecurityLogger("PASSWORD_CHANGE_FAILED", r, userID.(int), nil)
+		views.AddFlash(w, r, views.ErrorFlash(reauthFailedMessage))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	hash, err := utils.HashPassword(password)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Bumping the session version signs out every other session; this one
+	// gets a fresh token.
+	var email string
+	err = database.DB.QueryRow(`
+		UPDATE users SET password_hash = $1, session_version = session_version + 1
+		WHERE id = $2
+		RETURNING email
+	`, hash, userID).Scan(&email)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if err := setAuthCookie(w, userID.(int), false); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	middleware.SecurityLogger("PASSWORD_CHANGED", r, userID.(int), nil)
+
+	body := "Hello!\n\nThe password for your account was just changed. If this was not you, " +
+		"contact support immediately.\n"
+	if err := services.SendEmail(r.Context(), email, "Your password was changed", body); err != nil {
+		slog.ErrorContext(r.Context(), "failed to send password change notification", "error", err)
+	}
+
+	views.AddFlash(w, r, views.SuccessFlash("Password updated"))
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
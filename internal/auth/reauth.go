@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"example.com/m/v2/internal/database"
+	"example.com/m/v2/internal/middleware"
+	"example.com/m/v2/internal/utils"
+	"example.com/m/v2/internal/views"
+)
+
+const reauthCookie = "reauth"
+
+const reauthFailedMessage = "Could not confirm your identity: check your password, or sign in again with your provider"
+
+// maxReauthAge bounds how long ago the provider may have checked the
+// credentials when it reports auth_time.
+const maxReauthAge = 5 * time.Minute
+
+// confirmIdentity re-authenticates the user before a sensitive change.
+// Accounts with a password must enter it. Passwordless accounts, created
+// through OIDC, need a fresh sign in with their provider or, when allowCode
+// is set and two-factor authentication is on, a current code.
+func confirmIdentity(r *http.Request, userID int, allowCode bool) (bool, error) {
+	var hash string
+	var totpEnabledAt *time.Time
+	err := database.DB.QueryRow("SELECT password_hash, totp_enabled_at FROM users WHERE id = $1", userID).Scan(&hash, &totpEnabledAt)
+	if err != nil {
+		return false, err
+	}
+	if hash != "" {
+		return utils.CheckPasswordHash(r.FormValue("current_password"), hash), nil
+	}
+
+	if cookie, err := r.Cookie(reauthCookie); err == nil {
+		claims, err := utils.ParseJWT(cookie.Value)
+		if err == nil && claims["purpose"] == "reauth" && claims["sub"] == float64(userID) {
+			return true, nil
+		}
+	}
+	if allowCode && totpEnabledAt != nil && r.FormValue("code") != "" {
+		return verifySecondFactor(userID, r.FormValue("code"))
+	}
+	return false, nil
+}
+
+// linkedProviders lists the configured providers the user has signed in with.
+func linkedProviders(userID int) ([]*OIDCProvider, error) {
+	rows, err := database.DB.Query("SELECT provider FROM user_identities WHERE user_id = $1 ORDER BY provider", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var providers []*OIDCProvider
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if p, ok := oidcProviders[name]; ok {
+			providers = append(providers, p)
+		}
+	}
+	return providers, rows.Err()
+}
+
+// ReauthHandler sends a signed-in user back to a linked provider to confirm
+// their identity.
+func ReauthHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(int)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	p, ok := oidcProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var linked bool
+	err := database.DB.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM user_identities WHERE user_id = $1 AND provider = $2)",
+		userID, p.Name,
+	).Scan(&linked)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !linked {
+		http.NotFound(w, r)
+		return
+	}
+
+	startOIDC(w, r, p, userID)
+}
+
+func finishReauth(w http.ResponseWriter, r *http.Request, p *OIDCProvider, userID int, claims oidcClaims) {
+	fail := func(message string) {
+		middleware.SecurityLogger("REAUTH_FAILED", r, userID, middleware.Metadata{"provider": p.Name})
+		views.AddFlash(w, r, views.ErrorFlash(message))
+		redirectTmpl.Render(w, r, &PageData{PageCSS: "login", Data: "/profile"})
+	}
+
+	if claims.AuthTime != 0 && time.Since(time.Unix(claims.AuthTime, 0)) > maxReauthAge {
+		fail(p.DisplayName + " did not ask for your credentials again, please try again")
+		return
+	}
+
+	var owner int
+	err := database.DB.QueryRow(
+		"SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2",
+		p.Name, claims.Subject,
+	).Scan(&owner)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if owner != userID {
+		fail("Sign in with the account linked to your profile")
+		return
+	}
+
+	token, err := utils.CreateReauthJWT(userID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     reauthCookie,
+		Value:    token,
+		Path:     "/profile",
+		HttpOnly: true,
+		Secure:   middleware.SecureCookies(),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   600,
+	})
+
+	middleware.SecurityLogger("REAUTHENTICATED", r, userID, middleware.Metadata{"provider": p.Name})
+	views.AddFlash(w, r, views.SuccessFlash("Identity confirmed. You can change your account settings for the next 10 minutes"))
+	redirectTmpl.Render(w, r, &PageData{PageCSS: "login", Data: "/profile"})
+}
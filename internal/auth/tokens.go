@@ -0,0 +1,235 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+
+	"example.com/m/v2/internal/database"
+	"example.com/m/v2/internal/logging"
+	"example.com/m/v2/internal/middleware"
+	"example.com/m/v2/internal/utils"
+	"example.com/m/v2/internal/views"
+)
+
+var tokenCreatedTmpl = views.Must("layout.html", "token_created.html")
+
+const apiTokenPrefix = "bkp_"
+
+var APITokenScopes = []string{"books:read", "profile:read"}
+
+type APIToken struct {
+	ID         int
+	Name       string
+	Scopes     []string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+func listAPITokens(userID interface{}) ([]APIToken, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, name, scopes, created_at, last_used_at
+		FROM api_tokens
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		var t APIToken
+		if err := rows.Scan(&t.ID, &t.Name, pq.Array(&t.Scopes), &t.CreatedAt, &t.LastUsedAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func isKnownScope(scope string) bool {
+	for _, s := range APITokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func CreateAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID")
+	if userID == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	name := utils.SanitizeInput(r.FormValue("name"))
+	if name == "" || len(name) > 100 {
+		views.AddFlash(w, r, views.ErrorFlash("Token name is required"))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	scopes := []string{}
+	for _, scope := range r.Form["scopes"] {
+		if !isKnownScope(scope) {
+			views.AddFlash(w, r, views.ErrorFlash("Unknown token scope"))
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			return
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		views.AddFlash(w, r, views.ErrorFlash("Select at least one scope"))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	random, err := utils.GenerateToken(32)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	token := apiTokenPrefix + random
+
+	_, err = database.DB.Exec(`
+		INSERT INTO api_tokens (user_id, name, token_hash, scopes)
+		VALUES ($1, $2, $3, $4)
+	`, userID, name, utils.HashToken(token), pq.Array(scopes))
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	middleware.SecurityLogger("API_TOKEN_CREATED", r, userID.(int), middleware.Metadata{"name": name, "scopes": scopes})
+
+	data := PageData{
+		PageCSS: "profile",
+		Data: struct {
+			Name  string
+			Token string
+		}{name, token},
+	}
+	tokenCreatedTmpl.Render(w, r, &data)
+}
+
+func RevokeAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID")
+	if userID == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	res, err := database.DB.Exec(`
+		UPDATE api_tokens
+		SET revoked_at = now()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, id, userID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	middleware.SecurityLogger("API_TOKEN_REVOKED", r, userID.(int), middleware.Metadata{"token_id": id})
+	views.AddFlash(w, r, views.SuccessFlash("Token revoked"))
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+func TokenAuthMiddleware(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			token, ok := strings.CutPrefix(header, "Bearer ")
+			if !ok || !strings.HasPrefix(token, apiTokenPrefix) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+				utils.WriteJSONError(w, http.StatusUnauthorized, "missing or malformed bearer token")
+				return
+			}
+
+			var tokenID, userID int
+			var scopes []string
+			err := database.DB.QueryRow(`
+				SELECT id, user_id, scopes
+				FROM api_tokens
+				WHERE token_hash = $1 AND revoked_at IS NULL
+			`, utils.HashToken(token)).Scan(&tokenID, &userID, pq.Array(&scopes))
+			if err != nil {
+				if err != sql.ErrNoRows {
+					slog.ErrorContext(r.Context(), "failed to look up API token", "error", err)
+				}
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+				utils.WriteJSONError(w, http.StatusUnauthorized, "invalid or revoked token")
+				return
+			}
+
+			allowed := false
+			for _, s := range scopes {
+				if s == scope {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="api", error="insufficient_scope", scope=%q`, scope))
+				utils.WriteJSONError(w, http.StatusForbidden, "token lacks scope "+scope)
+				return
+			}
+
+			if _, err := database.DB.Exec("UPDATE api_tokens SET last_used_at = now() WHERE id = $1", tokenID); err != nil {
+				slog.WarnContext(r.Context(), "failed to update API token last use", "error", err)
+			}
+
+			logging.SetUserID(r.Context(), userID)
+			ctx := context.WithValue(r.Context(), "userID", userID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func APIMeHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID")
+
+	var user struct {
+		ID            int       `json:"id"`
+		Name          string    `json:"name"`
+		Email         string    `json:"email"`
+		EmailVerified bool      `json:"email_verified"`
+		CreatedAt     time.Time `json:"created_at"`
+	}
+	err := database.DB.QueryRow(`
+		SELECT id, COALESCE(name, ''), email, email_verified_at IS NOT NULL, created_at
+		FROM users
+		WHERE id = $1
+	`, userID).Scan(&user.ID, &user.Name, &user.Email, &user.EmailVerified, &user.CreatedAt)
+	if err != nil {
+		utils.WriteJSONError(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, user)
+}
@@ -0,0 +1,452 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"html/template"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+
+	"example.com/m/v2/internal/database"
+	"example.com/m/v2/internal/middleware"
+	"example.com/m/v2/internal/utils"
+	"example.com/m/v2/internal/views"
+)
+
+var twoFactorSetupTmpl = views.Must("layout.html", "twofactor_setup.html")
+var twoFactorRecoveryTmpl = views.Must("layout.html", "twofactor_recovery.html")
+var loginTwoFactorTmpl = views.Must("layout.html", "login_2fa.html")
+
+const (
+	totpIssuer         = "Books NYT"
+	totpPeriod         = 30
+	recoveryCodesCount = 10
+	twoFactorCookie    = "2fa_token"
+)
+
+type twoFactorSetup struct {
+	QRCode template.URL
+	Secret string
+}
+
+func validateTOTP(secret, code string) (int64, bool) {
+	code = strings.TrimSpace(code)
+	now := time.Now()
+	for _, skew := range []int64{0, -1, 1} {
+		t := now.Add(time.Duration(skew*totpPeriod) * time.Second)
+		expected, err := totp.GenerateCode(secret, t)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return t.Unix() / totpPeriod, true
+		}
+	}
+	return 0, false
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+func generateRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodesCount)
+	for i := 0; i < recoveryCodesCount; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))[:10]
+		code := raw[:5] + "-" + raw[5:]
+
+		_, err := tx.Exec(`
+			INSERT INTO user_recovery_codes (user_id, code_hash)
+			VALUES ($1, $2)
+		`, userID, utils.HashToken(normalizeRecoveryCode(code)))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func verifySecondFactor(userID int, code string) (bool, error) {
+	var secret sql.NullString
+	err := database.DB.QueryRow(`
+		SELECT totp_secret FROM users WHERE id = $1 AND totp_enabled_at IS NOT NULL
+	`, userID).Scan(&secret)
+	if err != nil {
+		return false, err
+	}
+	if !secret.Valid {
+		return false, nil
+	}
+
+	if counter, ok := validateTOTP(secret.String, code); ok {
+		res, err := database.DB.Exec(`
+			UPDATE users
+			SET totp_last_counter = $1
+			WHERE id = $2 AND (totp_last_counter IS NULL OR totp_last_counter < $1)
+		`, counter, userID)
+		if err != nil {
+			return false, err
+		}
+		n, _ := res.RowsAffected()
+		return n == 1, nil
+	}
+
+	res, err := database.DB.Exec(`
+		UPDATE user_recovery_codes
+		SET used_at = now()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`, userID, utils.HashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+func TwoFactorSetupPage(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID")
+	if userID == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	var email string
+	var enabledAt sql.NullTime
+	err := database.DB.QueryRow("SELECT email, totp_enabled_at FROM users WHERE id = $1", userID).Scan(&email, &enabledAt)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if enabledAt.Valid {
+		views.AddFlash(w, r, views.InfoFlash("Two-factor authentication is already enabled"))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	candidate, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: email,
+	})
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// A pending secret is kept until it is confirmed, so a refresh, a second
+	// tab or a link prefetch doesn't invalidate a QR code already scanned.
+	var secret string
+	err = database.DB.QueryRow(`
+		UPDATE users SET totp_secret = COALESCE(totp_secret, $1)
+		WHERE id = $2 AND totp_enabled_at IS NULL
+		RETURNING totp_secret
+	`, candidate.Secret(), userID).Scan(&secret)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	key, err := pendingTOTPKey(email, secret)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	img, err := key.Image(200, 200)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := PageData{
+		PageCSS: "profile",
+		Data: twoFactorSetup{
+			QRCode: template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())),
+			Secret: key.Secret(),
+		},
+	}
+	twoFactorSetupTmpl.Render(w, r, &data)
+}
+
+// pendingTOTPKey rebuilds the key for a stored base32 secret.
+func pendingTOTPKey(email, secret string) (*otp.Key, error) {
+	raw, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return nil, err
+	}
+	return totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: email,
+		Secret:      raw,
+	})
+}
+
+func EnableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID")
+	if userID == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	var secret sql.NullString
+	err := database.DB.QueryRow(`
+		SELECT totp_secret FROM users WHERE id = $1 AND totp_enabled_at IS NULL
+	`, userID).Scan(&secret)
+	if err != nil || !secret.Valid {
+		http.Redirect(w, r, "/profile/2fa/setup", http.StatusSeeOther)
+		return
+	}
+
+	counter, ok := validateTOTP(secret.String, r.FormValue("code"))
+	if !ok {
+		views.AddFlash(w, r, views.ErrorFlash("Invalid authentication code, please try again"))
+		http.Redirect(w, r, "/profile/2fa/setup", http.StatusSeeOther)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users
+		SET totp_enabled_at = now(), totp_last_counter = $1
+		WHERE id = $2
+	`, counter, userID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := generateRecoveryCodes(tx, userID.(int))
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	middleware.SecurityLogger("2FA_ENABLED", r, userID.(int), nil)
+
+	data := PageData{
+		PageCSS: "profile",
+		Data:    codes,
+	}
+	twoFactorRecoveryTmpl.Render(w, r, &data)
+}
+
+func DisableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID")
+	if userID == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	// The code below is the second factor itself, so it can't also stand in
+	// for the password here.
+	confirmed, err := confirmIdentity(r, userID.(int), false)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !confirmed {
+		views.AddFlash(w, r, views.ErrorFlash(reauthFailedMessage))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	ok, err := verifySecondFactor(userID.(int), r.FormValue("code"))
+	if err != nil || !ok {
+		views.AddFlash(w, r, views.ErrorFlash("Invalid authentication code"))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	if err := resetTwoFactor(userID.(int)); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	middleware.SecurityLogger("2FA_DISABLED", r, userID.(int), nil)
+	views.AddFlash(w, r, views.SuccessFlash("Two-factor authentication disabled"))
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+func resetTwoFactor(userID int) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users
+		SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_counter = NULL
+		WHERE id = $1
+	`, userID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func pendingTwoFactor(r *http.Request) (int, bool, error) {
+	cookie, err := r.Cookie(twoFactorCookie)
+	if err != nil {
+		return 0, false, err
+	}
+
+	claims, err := utils.ParseJWT(cookie.Value)
+	if err != nil {
+		return 0, false, err
+	}
+	if claims["purpose"] != "2fa" {
+		return 0, false, jwt.ErrTokenInvalidClaims
+	}
+
+	remember, _ := claims["remember"].(bool)
+	return int(claims["sub"].(float64)), remember, nil
+}
+
+func clearTwoFactorCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     twoFactorCookie,
+		Value:    "",
+		Path:     "/login/2fa",
+		HttpOnly: true,
+		Secure:   middleware.SecureCookies(),
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   -1,
+	})
+}
+
+func setTwoFactorCookie(w http.ResponseWriter, userID int, remember bool) error {
+	tokenString, err := utils.CreateTwoFactorJWT(userID, remember)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     twoFactorCookie,
+		Value:    tokenString,
+		Path:     "/login/2fa",
+		HttpOnly: true,
+		Secure:   middleware.SecureCookies(),
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   300,
+	})
+	return nil
+}
+
+func LoginTwoFactorPage(w http.ResponseWriter, r *http.Request) {
+	if _, _, err := pendingTwoFactor(r); err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	data := PageData{
+		PageCSS: "login",
+	}
+	loginTwoFactorTmpl.Render(w, r, &data)
+}
+
+func LoginTwoFactorSubmit(w http.ResponseWriter, r *http.Request) {
+	userID, remember, err := pendingTwoFactor(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	var email string
+	if err := database.DB.QueryRow("SELECT email FROM users WHERE id = $1", userID).Scan(&email); err != nil {
+		clearTwoFactorCookie(w)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	lockedUntil, err := loginLockedUntil(r, email)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !lockedUntil.IsZero() {
+		loginTwoFactorTmpl.Render(w, r, &PageData{
+			Layout:  views.Layout{Flashes: []views.Flash{views.ErrorFlash("Too many failed attempts. Try again in " + formatRetryAfter(lockedUntil))}},
+			PageCSS: "login",
+		})
+		return
+	}
+
+	ok, err := verifySecondFactor(userID, r.FormValue("code"))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to verify second factor", "subject_id", userID, "error", err)
+	}
+	if !ok {
+		middleware.SecurityLogger("2FA_FAILED", r, userID, middleware.Metadata{"email": email})
+		recordLoginFailure(r, email)
+		loginTwoFactorTmpl.Render(w, r, &PageData{
+			Layout:  views.Layout{Flashes: []views.Flash{views.ErrorFlash("Invalid authentication code")}},
+			PageCSS: "login",
+		})
+		return
+	}
+
+	middleware.LogSuccessfulLogin(r, email)
+	clearLoginFailures(email)
+	clearTwoFactorCookie(w)
+
+	if err := setAuthCookie(w, userID, remember); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+func TestPendingTOTPKeyReusesStoredSecret(t *testing.T) {
+	stored, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: "a@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := pendingTOTPKey("a@example.com", stored.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Secret() != stored.Secret() || key.URL() != stored.URL() {
+		t.Fatalf("rebuilt key = %s, want %s", key.URL(), stored.URL())
+	}
+
+	// A code from the app that scanned the first QR code still validates.
+	code, err := totp.GenerateCode(stored.Secret(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := validateTOTP(key.Secret(), code); !ok {
+		t.Error("code for the stored secret was rejected")
+	}
+
+	if _, err := pendingTOTPKey("a@example.com", "not base32!"); err == nil {
+		t.Error("a malformed stored secret was accepted")
+	}
+}
@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"example.com/m/v2/internal/database"
+	"example.com/m/v2/internal/models"
+	"example.com/m/v2/internal/utils"
+)
+
+const minPasswordLength = 8
+
+var ErrUserNotFound = errors.New("user not found")
+
+// CreateUser adds an account for operators, outside of the sign-up form.
+func CreateUser(ctx context.Context, email, name, password string, admin bool) (int, error) {
+	email = utils.NormalizeEmail(email)
+	if !utils.IsValidEmail(email) {
+		return 0, fmt.Errorf("invalid email %q", email)
+	}
+	if len(password) < minPasswordLength {
+		return 0, fmt.Errorf("the password must contain at least %d characters", minPasswordLength)
+	}
+	hash, err := utils.HashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+
+	role := "user"
+	if admin {
+		role = "admin"
+	}
+
+	var userID int
+	err = database.DB.QueryRowContext(ctx, `
+		INSERT INTO users (email, password_hash, name, role)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, email, hash, utils.SanitizeInput(name), role).Scan(&userID)
+	if database.IsUniqueViolation(err) {
+		return 0, fmt.Errorf("an account with email %s already exists", email)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	logOperatorEvent(ctx, "REGISTRATION", userID, map[string]interface{}{"email": email, "role": role})
+	return userID, nil
+}
+
+// ResetPassword sets a new password, ends the user's sessions and lifts any
+// login lockout.
+func ResetPassword(ctx context.Context, email, password string) (int, error) {
+	if len(password) < minPasswordLength {
+		return 0, fmt.Errorf("the password must contain at least %d characters", minPasswordLength)
+	}
+	hash, err := utils.HashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+
+	var userID int
+	err = database.DB.QueryRowContext(ctx,
+		"UPDATE users SET password_hash = $1, session_version = session_version + 1 WHERE email = $2 RETURNING id",
+		hash, utils.NormalizeEmail(email),
+	).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrUserNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	clearLoginFailures(email)
+	logOperatorEvent(ctx, "PASSWORD_RESET", userID, map[string]interface{}{"email": email})
+	return userID, nil
+}
+
+// logOperatorEvent records changes made from the command line, where there
+// is no request to take the actor and client address from.
+func logOperatorEvent(ctx context.Context, event string, userID int, metadata map[string]interface{}) {
+	metadata["via"] = "cli"
+	email, _ := metadata["email"].(string)
+	err := database.InsertAuditEvent(ctx, models.AuditEvent{
+		Event:     event,
+		UserID:    userID,
+		UserEmail: email,
+		Metadata:  metadata,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to save audit event", "event", event, "error", err)
+	}
+}
@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"example.com/m/v2/internal/database"
+)
+
+func TestEmailsAreCaseInsensitive(t *testing.T) {
+	requireDB(t)
+	email := uniqueEmail(t)
+	deleteUser(t, email)
+	ctx := context.Background()
+
+	id, err := CreateUser(ctx, strings.ToUpper(email), "Mixed Case", "password123", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored string
+	if err := database.DB.QueryRow("SELECT email FROM users WHERE id = $1", id).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != email {
+		t.Errorf("stored email = %q, want %q", stored, email)
+	}
+
+	if _, err := CreateUser(ctx, email, "Duplicate", "password123", false); err == nil {
+		t.Error("created a second account for the same address in another case")
+	}
+	if got, err := ResetPassword(ctx, strings.ToUpper(email), "password456"); err != nil || got != id {
+		t.Errorf("ResetPassword with the address in upper case = %d, %v; want %d", got, err, id)
+	}
+
+	// The index catches writers that skip normalisation.
+	_, err = database.DB.Exec(
+		"INSERT INTO users (email, password_hash, name) VALUES ($1, '', 'Raw')", strings.ToUpper(email),
+	)
+	if !database.IsUniqueViolation(err) {
+		t.Errorf("raw insert in another case = %v, want a unique violation", err)
+	}
+}
@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"example.com/m/v2/internal/database"
+	"example.com/m/v2/internal/middleware"
+	"example.com/m/v2/internal/services"
+	"example.com/m/v2/internal/utils"
+	"example.com/m/v2/internal/views"
+)
+
+const (
+	verificationTTL            = 24 * time.Hour
+	verificationResendInterval = time.Minute
+	maxVerificationsPerHour    = 3
+)
+
+var errVerificationRateLimited = errors.New("too many verification emails requested")
+
+func sendVerificationEmail(ctx context.Context, userID int, email string) error {
+	token, err := utils.GenerateToken(32)
+	if err != nil {
+		return fmt.Errorf("failed to generate verification token: %w", err)
+	}
+
+	_, err = database.DB.Exec(`
+		INSERT INTO email_verifications (user_id, email, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`, userID, email, utils.HashToken(token), time.Now().Add(verificationTTL))
+	if err != nil {
+		return fmt.Errorf("failed to save verification token: %w", err)
+	}
+
+	link := fmt.Sprintf("%s/verify-email?token=%s", getAppBaseURL(), url.QueryEscape(token))
+	body := fmt.Sprintf(
+		"Hello!\n\nPlease confirm your email address by opening the link below:\n\n%s\n\n"+
+			"The link expires in 24 hours. If you did not create an account, just ignore this email.\n",
+		link,
+	)
+	return services.SendEmail(ctx, email, "Confirm your email address", body)
+}
+
+func checkVerificationRateLimit(userID int) error {
+	var sent int
+	var last sql.NullTime
+	err := database.DB.QueryRow(`
+		SELECT COUNT(*), MAX(created_at)
+		FROM email_verifications
+		WHERE user_id = $1 AND created_at > now() - interval '1 hour'
+	`, userID).Scan(&sent, &last)
+	if err != nil {
+		return err
+	}
+
+	if sent >= maxVerificationsPerHour {
+		return errVerificationRateLimited
+	}
+	if last.Valid && time.Since(last.Time) < verificationResendInterval {
+		return errVerificationRateLimited
+	}
+	return nil
+}
+
+func isEmailVerified(userID interface{}) (bool, error) {
+	var verifiedAt sql.NullTime
+	err := database.DB.QueryRow("SELECT email_verified_at FROM users WHERE id = $1", userID).Scan(&verifiedAt)
+	if err != nil {
+		return false, err
+	}
+	return verifiedAt.Valid, nil
+}
+
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		views.AddFlash(w, r, views.ErrorFlash("Invalid verification link"))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var email string
+	err = tx.QueryRow(`
+		UPDATE email_verifications
+		SET used_at = now()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now()
+		RETURNING user_id, email
+	`, utils.HashToken(token)).Scan(&userID, &email)
+	if err != nil {
+		views.AddFlash(w, r, views.ErrorFlash("Verification link is invalid or expired"))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	var previousEmail string
+	err = tx.QueryRow(`
+		UPDATE users u
+		SET email = $2, email_verified_at = now()
+		FROM (SELECT email FROM users WHERE id = $1) prev
+		WHERE u.id = $1
+		RETURNING prev.email
+	`, userID, email).Scan(&previousEmail)
+	if err != nil {
+		if database.IsUniqueViolation(err) {
+			views.AddFlash(w, r, views.ErrorFlash("This email address is already in use"))
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			return
+		}
+		views.AddFlash(w, r, views.ErrorFlash("Verification link is invalid or expired"))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE email_verifications
+		SET used_at = now()
+		WHERE user_id = $1 AND used_at IS NULL
+	`, userID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if previousEmail != email {
+		middleware.SecurityLogger("EMAIL_CHANGED", r, userID, middleware.Metadata{"from": previousEmail, "to": email})
+	} else {
+		middleware.SecurityLogger("EMAIL_VERIFIED", r, userID, middleware.Metadata{"email": email})
+	}
+
+	if previousEmail != email {
+		clearLoginFailures(previousEmail)
+		body := fmt.Sprintf("Hello!\n\nThe email address of your account was changed to %s. "+
+			"If this was not you, contact support immediately.\n", email)
+		if err := services.SendEmail(r.Context(), previousEmail, "Your email address was changed", body); err != nil {
+			slog.ErrorContext(r.Context(), "failed to send email change notification", "subject_id", userID, "error", err)
+		}
+	}
+
+	views.AddFlash(w, r, views.SuccessFlash("Email address verified"))
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+func ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID")
+	if userID == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	var email string
+	var verifiedAt sql.NullTime
+	err := database.DB.QueryRow("SELECT email, email_verified_at FROM users WHERE id = $1", userID).Scan(&email, &verifiedAt)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if verifiedAt.Valid {
+		views.AddFlash(w, r, views.InfoFlash("Email address is already verified"))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	if err := checkVerificationRateLimit(userID.(int)); err != nil {
+		if errors.Is(err, errVerificationRateLimited) {
+			views.AddFlash(w, r, views.ErrorFlash("Please wait before requesting another email"))
+			http.Redirect(w, r, "/profile", http.StatusSeeOther)
+			return
+		}
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := sendVerificationEmail(r.Context(), userID.(int), email); err != nil {
+		slog.ErrorContext(r.Context(), "failed to send verification email", "error", err)
+		views.AddFlash(w, r, views.ErrorFlash("Could not send verification email"))
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+
+	views.AddFlash(w, r, views.InfoFlash("Verification email sent"))
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
@@ -0,0 +1,347 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the whole service configuration. Values come from the defaults
+// below, then the YAML file, then the environment (including .env), each
+// overriding the previous one. Env names are given by the env tags.
+type Config struct {
+	Env        string         `yaml:"env" env:"APP_ENV"`
+	BaseURL    string         `yaml:"base_url" env:"APP_BASE_URL"`
+	Server     Server         `yaml:"server"`
+	Database   Database       `yaml:"database"`
+	NYT        NYT            `yaml:"nyt"`
+	Cloudinary Cloudinary     `yaml:"cloudinary"`
+	SMTP       SMTP           `yaml:"smtp"`
+	JWT        JWT            `yaml:"jwt"`
+	Security   Security       `yaml:"security"`
+	RateLimit  RateLimit      `yaml:"rate_limit"`
+	Accounts   Accounts       `yaml:"accounts"`
+	OIDC       []OIDCProvider `yaml:"oidc"`
+	Log        Log            `yaml:"log"`
+	Metrics    Metrics        `yaml:"metrics"`
+	Health     Health         `yaml:"health"`
+	Tracing    Tracing        `yaml:"tracing"`
+	Views      Views          `yaml:"views"`
+
+	// Files lists the configuration files that were read.
+	Files []string `yaml:"-"`
+}
+
+type Server struct {
+	Addr              string        `yaml:"addr" env:"HTTP_ADDR"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"HTTP_READ_HEADER_TIMEOUT"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" env:"HTTP_READ_TIMEOUT"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"HTTP_WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"HTTP_IDLE_TIMEOUT"`
+	// DrainDelay keeps serving after SIGTERM so load balancers notice the
+	// instance is going away before it stops accepting connections.
+	DrainDelay      time.Duration `yaml:"drain_delay" env:"SHUTDOWN_DRAIN_DELAY"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+}
+
+type Database struct {
+	Host     string `yaml:"host" env:"DB_HOST"`
+	Port     int    `yaml:"port" env:"DB_PORT"`
+	User     string `yaml:"user" env:"DB_USER"`
+	Password string `yaml:"password" env:"DB_PASSWORD"`
+	Name     string `yaml:"name" env:"DB_NAME"`
+	SSLMode  string `yaml:"sslmode" env:"DB_SSLMODE"`
+	// MigrateOnStart applies pending migrations before serving.
+	MigrateOnStart bool `yaml:"migrate_on_start" env:"MIGRATE_ON_START"`
+}
+
+type NYT struct {
+	APIKey string `yaml:"api_key" env:"API_KEY"`
+}
+
+type Cloudinary struct {
+	CloudName string `yaml:"cloud_name" env:"CLOUDINARY_CLOUD_NAME"`
+	APIKey    string `yaml:"api_key" env:"CLOUDINARY_API_KEY"`
+	APISecret string `yaml:"api_secret" env:"CLOUDINARY_API_SECRET"`
+}
+
+func (c Cloudinary) Enabled() bool {
+	return c.CloudName != "" || c.APIKey != "" || c.APISecret != ""
+}
+
+type SMTP struct {
+	Host     string `yaml:"host" env:"SMTP_HOST"`
+	Port     int    `yaml:"port" env:"SMTP_PORT"`
+	Username string `yaml:"username" env:"SMTP_USERNAME"`
+	Password string `yaml:"password" env:"SMTP_PASSWORD"`
+	From     string `yaml:"from" env:"SMTP_FROM"`
+}
+
+type JWT struct {
+	Secret    string `yaml:"secret" env:"JWT_SECRET"`
+	Keys      string `yaml:"keys" env:"JWT_KEYS"`
+	ActiveKID string `yaml:"active_kid" env:"JWT_ACTIVE_KID"`
+}
+
+type Security struct {
+	CSRFKey        string   `yaml:"csrf_key" env:"CSRF_KEY"`
+	CookieSecure   *bool    `yaml:"cookie_secure" env:"COOKIE_SECURE"`
+	TrustedOrigins []string `yaml:"trusted_origins" env:"TRUSTED_ORIGINS"`
+	HSTSMaxAge     *int     `yaml:"hsts_max_age" env:"HSTS_MAX_AGE"`
+	TrustedProxies []string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+	// ProxyHeader names the header the trusted proxies write: xff for
+	// X-Forwarded-For or forwarded for the standard Forwarded header.
+	ProxyHeader   string `yaml:"proxy_header" env:"PROXY_HEADER"`
+	CSPPolicy     string `yaml:"csp_policy" env:"CSP_POLICY"`
+	CSPReportOnly bool   `yaml:"csp_report_only" env:"CSP_REPORT_ONLY"`
+}
+
+type RateLimit struct {
+	Store string `yaml:"store" env:"RATE_LIMIT_STORE"`
+	// File is a JSON file of policies, Limits a list like "auth=5/m:5".
+	File     string                     `yaml:"file" env:"RATE_LIMITS_FILE"`
+	Limits   string                     `yaml:"limits" env:"RATE_LIMITS"`
+	Policies map[string]RateLimitPolicy `yaml:"policies"`
+}
+
+type RateLimitPolicy struct {
+	Rate    string `yaml:"rate" json:"rate"`
+	Burst   int    `yaml:"burst" json:"burst"`
+	PerUser *bool  `yaml:"per_user" json:"per_user"`
+}
+
+type Accounts struct {
+	DeletionGraceDays int    `yaml:"deletion_grace_days" env:"ACCOUNT_DELETION_GRACE_DAYS"`
+	DefaultAvatarURL  string `yaml:"default_avatar_url" env:"DEFAULT_AVATAR_URL"`
+}
+
+type OIDCProvider struct {
+	Name         string `yaml:"name"`
+	DisplayName  string `yaml:"display_name"`
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+}
+
+type Log struct {
+	Level  string `yaml:"level" env:"LOG_LEVEL"`
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+}
+
+type Metrics struct {
+	Token string `yaml:"token" env:"METRICS_TOKEN"`
+}
+
+type Health struct {
+	// MaxIngestionAge fails readiness when the newest book is older; zero
+	// only reports the age.
+	MaxIngestionAge time.Duration `yaml:"max_ingestion_age" env:"READY_MAX_INGESTION_AGE"`
+}
+
+type Tracing struct {
+	Exporter    string `yaml:"exporter" env:"OTEL_TRACES_EXPORTER"`
+	ServiceName string `yaml:"service_name" env:"OTEL_SERVICE_NAME"`
+}
+
+type Views struct {
+	// Dir reads templates and assets from disk instead of the binary, for
+	// editing them without a rebuild.
+	Dir string `yaml:"dir" env:"VIEWS_DIR"`
+}
+
+func Default() *Config {
+	return &Config{
+		Env:     "dev",
+		BaseURL: "http://localhost:8000",
+		Server: Server{
+			Addr:              ":8000",
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       15 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   20 * time.Second,
+		},
+		Database: Database{Host: "localhost", Port: 5432, SSLMode: "disable", MigrateOnStart: true},
+		SMTP:     SMTP{Port: 587},
+		Security: Security{ProxyHeader: "xff"},
+		RateLimit: RateLimit{
+			Store: "memory",
+		},
+		Accounts: Accounts{
+			DeletionGraceDays: 14,
+			DefaultAvatarURL:  "/static/default-avatar.png",
+		},
+		Log:     Log{Level: "info", Format: "json"},
+		Tracing: Tracing{Exporter: "none", ServiceName: "books"},
+	}
+}
+
+// Load reads .env into the environment, then builds the configuration from
+// the YAML file at path (or CONFIG_FILE) and the environment and validates it.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if err := godotenv.Load(); err == nil {
+		cfg.Files = append(cfg.Files, ".env")
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf(".env: %w", err)
+	}
+
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		cfg.Files = append(cfg.Files, path)
+	}
+
+	// The docker compose setup names its environments with ENV.
+	if os.Getenv("APP_ENV") == "" && strings.EqualFold(os.Getenv("ENV"), "prod") {
+		cfg.Env = "prod"
+	}
+	if err := applyEnv(reflect.ValueOf(cfg).Elem()); err != nil {
+		return nil, err
+	}
+	cfg.applyOIDCEnv()
+
+	cfg.normalize()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func applyEnv(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fv := v.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnv(fv); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := field.Tag.Get("env")
+		value := strings.TrimSpace(os.Getenv(name))
+		if name == "" || value == "" {
+			continue
+		}
+		if err := setValue(fv, value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setValue(fv reflect.Value, value string) error {
+	switch fv.Interface().(type) {
+	case string:
+		fv.SetString(value)
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration like 30s or 2m", value)
+		}
+		fv.SetInt(int64(d))
+	case int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		fv.SetInt(int64(n))
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		fv.SetBool(b)
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		fv.Set(reflect.ValueOf(&n))
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		fv.Set(reflect.ValueOf(&b))
+	case []string:
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		fv.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported field type %s", fv.Type())
+	}
+	return nil
+}
+
+// applyOIDCEnv replaces the providers with OIDC_PROVIDERS, a comma separated
+// list of names each configured by OIDC_<NAME>_ISSUER, _CLIENT_ID,
+// _CLIENT_SECRET and _NAME.
+func (c *Config) applyOIDCEnv() {
+	names := os.Getenv("OIDC_PROVIDERS")
+	if names == "" {
+		return
+	}
+
+	c.OIDC = nil
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		c.OIDC = append(c.OIDC, OIDCProvider{
+			Name:         name,
+			DisplayName:  os.Getenv(prefix + "NAME"),
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+		})
+	}
+}
+
+func (c *Config) normalize() {
+	switch c.Env = strings.ToLower(strings.TrimSpace(c.Env)); c.Env {
+	case "development", "local":
+		c.Env = "dev"
+	case "production":
+		c.Env = "prod"
+	}
+	c.BaseURL = strings.TrimRight(c.BaseURL, "/")
+	c.Log.Level = strings.ToLower(c.Log.Level)
+	c.Log.Format = strings.ToLower(c.Log.Format)
+	c.Tracing.Exporter = strings.ToLower(c.Tracing.Exporter)
+	for i := range c.OIDC {
+		p := &c.OIDC[i]
+		p.Name = strings.ToLower(strings.TrimSpace(p.Name))
+		if p.DisplayName == "" {
+			p.DisplayName = p.Name
+		}
+	}
+}
+
+func (c *Config) IsProd() bool {
+	return c.Env == "prod"
+}
@@ -0,0 +1,153 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Placeholder values from the README that must never reach production.
+var placeholderCSRFKeys = map[string]bool{
+	"32-byte-long-auth-key-change-me!": true,
+	"your_csrf_key":                    true,
+	"changeme":                         true,
+}
+
+// Validate reports every problem at once, naming both the YAML key and the
+// environment variable.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Env != "dev" && c.Env != "prod" {
+		fail("env (APP_ENV) must be dev or prod, got %q", c.Env)
+	}
+	if u, err := url.Parse(c.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fail("base_url (APP_BASE_URL) must be an absolute http(s) URL, got %q", c.BaseURL)
+	} else if c.IsProd() && u.Scheme != "https" {
+		fail("base_url (APP_BASE_URL) must use https in the prod profile, got %q", c.BaseURL)
+	}
+
+	if c.Server.Addr == "" {
+		fail("server.addr (HTTP_ADDR) is required")
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"server.read_header_timeout (HTTP_READ_HEADER_TIMEOUT)", c.Server.ReadHeaderTimeout},
+		{"server.read_timeout (HTTP_READ_TIMEOUT)", c.Server.ReadTimeout},
+		{"server.write_timeout (HTTP_WRITE_TIMEOUT)", c.Server.WriteTimeout},
+		{"server.idle_timeout (HTTP_IDLE_TIMEOUT)", c.Server.IdleTimeout},
+		{"server.shutdown_timeout (SHUTDOWN_TIMEOUT)", c.Server.ShutdownTimeout},
+	} {
+		if d.value <= 0 {
+			fail("%s must be positive, got %s", d.name, d.value)
+		}
+	}
+	if c.Server.DrainDelay < 0 {
+		fail("server.drain_delay (SHUTDOWN_DRAIN_DELAY) must not be negative")
+	}
+
+	if c.Database.Host == "" {
+		fail("database.host (DB_HOST) is required")
+	}
+	if c.Database.Port < 1 || c.Database.Port > 65535 {
+		fail("database.port (DB_PORT) must be between 1 and 65535, got %d", c.Database.Port)
+	}
+	if c.Database.User == "" {
+		fail("database.user (DB_USER) is required")
+	}
+	if c.Database.Name == "" {
+		fail("database.name (DB_NAME) is required")
+	}
+
+	if c.Cloudinary.Enabled() && (c.Cloudinary.CloudName == "" || c.Cloudinary.APIKey == "" || c.Cloudinary.APISecret == "") {
+		fail("cloudinary needs cloud_name, api_key and api_secret (CLOUDINARY_CLOUD_NAME, CLOUDINARY_API_KEY, CLOUDINARY_API_SECRET) together")
+	}
+
+	if c.IsProd() && c.SMTP.Host == "" {
+		fail("smtp.host (SMTP_HOST) must be set in the prod profile")
+	}
+	if c.SMTP.Host != "" && c.SMTP.From == "" {
+		fail("smtp.from (SMTP_FROM) is required when smtp.host (SMTP_HOST) is set")
+	}
+	if c.SMTP.Port < 1 || c.SMTP.Port > 65535 {
+		fail("smtp.port (SMTP_PORT) must be between 1 and 65535, got %d", c.SMTP.Port)
+	}
+
+	if c.JWT.Secret == "" && c.JWT.Keys == "" {
+		fail("jwt.secret (JWT_SECRET) or jwt.keys (JWT_KEYS) is required")
+	}
+
+	key := c.Security.CSRFKey
+	if c.IsProd() {
+		switch {
+		case key == "":
+			fail("security.csrf_key (CSRF_KEY) must be set in the prod profile")
+		case len(key) < 32 || placeholderCSRFKeys[strings.ToLower(key)]:
+			fail("security.csrf_key (CSRF_KEY) is a placeholder or shorter than 32 characters")
+		}
+	}
+	// /metrics is served on the public listener, so prod must not leave it open.
+	if c.IsProd() && (c.Metrics.Token == "" || strings.EqualFold(c.Metrics.Token, "your_METRICS_TOKEN")) {
+		fail("metrics.token (METRICS_TOKEN) must be set in the prod profile")
+	}
+	if c.Security.HSTSMaxAge != nil && *c.Security.HSTSMaxAge < 0 {
+		fail("security.hsts_max_age (HSTS_MAX_AGE) must not be negative")
+	}
+
+	if c.Security.ProxyHeader != "xff" && c.Security.ProxyHeader != "forwarded" {
+		fail("security.proxy_header (PROXY_HEADER) must be xff or forwarded, got %q", c.Security.ProxyHeader)
+	}
+
+	if c.RateLimit.Store != "memory" && c.RateLimit.Store != "postgres" {
+		fail("rate_limit.store (RATE_LIMIT_STORE) must be memory or postgres, got %q", c.RateLimit.Store)
+	}
+
+	if c.Accounts.DeletionGraceDays < 0 {
+		fail("accounts.deletion_grace_days (ACCOUNT_DELETION_GRACE_DAYS) must not be negative")
+	}
+
+	seen := map[string]bool{}
+	for _, p := range c.OIDC {
+		prefix := "OIDC_" + strings.ToUpper(p.Name) + "_"
+		switch {
+		case p.Name == "":
+			fail("oidc: every provider needs a name")
+		case seen[p.Name]:
+			fail("oidc: provider %q is defined twice", p.Name)
+		case p.Issuer == "" || p.ClientID == "":
+			fail("oidc: provider %q requires issuer and client_id (%sISSUER, %sCLIENT_ID)", p.Name, prefix, prefix)
+		}
+		seen[p.Name] = true
+	}
+
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		fail("log.level (LOG_LEVEL) must be debug, info, warn or error, got %q", c.Log.Level)
+	}
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		fail("log.format (LOG_FORMAT) must be json or text, got %q", c.Log.Format)
+	}
+
+	if c.Health.MaxIngestionAge < 0 {
+		fail("health.max_ingestion_age (READY_MAX_INGESTION_AGE) must not be negative")
+	}
+
+	switch c.Tracing.Exporter {
+	case "otlp", "stdout", "none":
+	default:
+		fail("tracing.exporter (OTEL_TRACES_EXPORTER) must be otlp, stdout or none, got %q", c.Tracing.Exporter)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
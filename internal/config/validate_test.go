@@ -0,0 +1,63 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func prodConfig() *Config {
+	cfg := Default()
+	cfg.Env = "prod"
+	cfg.BaseURL = "https://books.example.com"
+	cfg.Database.User = "books"
+	cfg.Database.Name = "books"
+	cfg.JWT.Secret = "a-long-enough-secret-for-the-tests"
+	cfg.Security.CSRFKey = "0123456789abcdef0123456789abcdef"
+	cfg.Metrics.Token = "metrics-token"
+	cfg.SMTP.Host = "smtp.example.com"
+	cfg.SMTP.From = "books@example.com"
+	return cfg
+}
+
+func TestValidateMetricsToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		token   string
+		wantErr bool
+	}{
+		{"prod with token", "prod", "metrics-token", false},
+		{"prod without token", "prod", "", true},
+		{"prod with README placeholder", "prod", "your_METRICS_TOKEN", true},
+		{"dev without token", "dev", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := prodConfig()
+			cfg.Env = tt.env
+			cfg.Metrics.Token = tt.token
+
+			err := cfg.Validate()
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "METRICS_TOKEN") {
+					t.Fatalf("Validate() = %v, want a METRICS_TOKEN error", err)
+				}
+			} else if err != nil {
+				t.Fatalf("Validate() = %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateRequiresSMTPInProd(t *testing.T) {
+	cfg := prodConfig()
+	cfg.SMTP.Host = ""
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "SMTP_HOST") {
+		t.Fatalf("Validate() = %v, want an SMTP_HOST error", err)
+	}
+
+	cfg.Env = "dev"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("dev without SMTP: Validate() = %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"example.com/m/v2/internal/models"
+)
+
+func nullInt(v int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(v), Valid: v != 0}
+}
+
+func InsertAuditEvent(ctx context.Context, e models.AuditEvent) error {
+	metadata, err := json.Marshal(e.Metadata)
+	if err != nil {
+		return err
+	}
+	if e.Metadata == nil {
+		metadata = []byte("{}")
+	}
+
+	_, err = DB.ExecContext(ctx, `
+		INSERT INTO audit_events (event, user_id, actor_id, ip, user_agent, metadata)
+		VALUES ($1, COALESCE($2, (SELECT id FROM users WHERE email = $3)), $4, $5, $6, $7)
+	`, e.Event, nullInt(e.UserID), e.UserEmail, nullInt(e.ActorID), e.IP, e.UserAgent, metadata)
+	return err
+}
+
+func ListAuditEvents(ctx context.Context, f models.AuditFilter) ([]models.AuditEvent, error) {
+	var where []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+
+	if f.Event != "" {
+		add("a.event = $%d", f.Event)
+	}
+	if f.UserID != 0 {
+		add("a.user_id = $%d", f.UserID)
+	}
+	if f.Email != "" {
+		add("u.email ILIKE '%%' || $%d || '%%'", f.Email)
+	}
+	if !f.Since.IsZero() {
+		add("a.created_at >= $%d", f.Since)
+	}
+	if !f.Until.IsZero() {
+		add("a.created_at < $%d", f.Until)
+	}
+
+	query := `
+		SELECT a.id, a.event, COALESCE(a.user_id, 0), COALESCE(u.email, ''), COALESCE(a.actor_id, 0),
+			COALESCE(actor.email, ''), COALESCE(a.ip, ''), COALESCE(a.user_agent, ''), a.metadata, a.created_at
+		FROM audit_events a
+		LEFT JOIN users u ON u.id = a.user_id
+		LEFT JOIN users actor ON actor.id = a.actor_id`
+	if len(where) > 0 {
+		query += "\n\t\tWHERE " + strings.Join(where, " AND ")
+	}
+
+	limit := f.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	args = append(args, limit, f.Offset)
+	query += fmt.Sprintf("\n\t\tORDER BY a.created_at DESC, a.id DESC\n\t\tLIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+	rows, err := DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.AuditEvent{}
+	for rows.Next() {
+		var e models.AuditEvent
+		var metadata []byte
+		if err := rows.Scan(&e.ID, &e.Event, &e.UserID, &e.UserEmail, &e.ActorID, &e.ActorEmail, &e.IP, &e.UserAgent, &metadata, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(metadata, &e.Metadata); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func ListAuditEventTypes(ctx context.Context) ([]string, error) {
+	rows, err := DB.QueryContext(ctx, "SELECT DISTINCT event FROM audit_events ORDER BY event")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var types []string
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err != nil {
+			return nil, err
+		}
+		types = append(types, t)
+	}
+	return types, rows.Err()
+}
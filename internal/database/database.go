@@ -1,45 +1,85 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	"log"
-	"os"
+	"log/slog"
 
+	"example.com/m/v2/internal/config"
 	"example.com/m/v2/internal/models"
-	_ "github.com/lib/pq"
+	"github.com/XSAM/otelsql"
+	"github.com/lib/pq"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var DB *sql.DB
 
-func Init() *sql.DB {
+func Init(cfg config.Database) *sql.DB {
 	connStr := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		os.Getenv("DB_HOST"),
-		os.Getenv("DB_PORT"),
-		os.Getenv("DB_USER"),
-		os.Getenv("DB_PASSWORD"),
-		os.Getenv("DB_NAME"),
+		"host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		cfg.Host,
+		cfg.Port,
+		cfg.User,
+		cfg.Password,
+		cfg.Name,
+		cfg.SSLMode,
+	)
+	database, err := otelsql.Open("postgres", connStr,
+		otelsql.WithAttributes(semconv.DBSystemNamePostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitRows: true,
+			// Only trace queries that belong to a traced request or job.
+			SpanFilter: func(ctx context.Context, _ otelsql.Method, _ string, _ []driver.NamedValue) bool {
+				return trace.SpanContextFromContext(ctx).IsValid()
+			},
+		}),
 	)
-	database, err := sql.Open("postgres", connStr)
 	if err != nil {
 		log.Fatal(err)
 	}
 	return database
 }
 
-func CountBooks() int {
+func CountBooks(ctx context.Context) int {
 	var count int
-	err := DB.QueryRow("SELECT COUNT(*) FROM books").Scan(&count)
+	err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM books").Scan(&count)
 	if err != nil {
-		log.Println("Error in counting books:", err)
+		slog.ErrorContext(ctx, "failed to count books", "error", err)
 	}
 	return count
 }
 
-func GetBookByID(id int) (*models.Book, error) {
+func ListBooks(ctx context.Context, limit, offset int) ([]models.Book, error) {
+	rows, err := DB.QueryContext(ctx, `
+		SELECT id, title, author, description, publisher, image, amazon_url, rank
+		FROM books
+		ORDER BY rank, id
+		LIMIT $1 OFFSET $2
+	`, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := []models.Book{}
+	for rows.Next() {
+		var b models.Book
+		if err := rows.Scan(&b.ID, &b.Title, &b.Author, &b.Description, &b.Publisher, &b.Image, &b.AmazonURL, &b.Rank); err != nil {
+			return nil, err
+		}
+		books = append(books, b)
+	}
+	return books, rows.Err()
+}
+
+func GetBookByID(ctx context.Context, id int) (*models.Book, error) {
 	var b models.Book
-	err := DB.QueryRow(`
+	err := DB.QueryRowContext(ctx, `
 		SELECT id, title, author, description, publisher, image, amazon_url, rank
 		FROM books
 		WHERE id=$1
@@ -48,9 +88,9 @@ func GetBookByID(id int) (*models.Book, error) {
 		return nil, err
 	}
 
-	rows, err := DB.Query(`SELECT name, url FROM book_links WHERE book_id=$1`, id)
+	rows, err := DB.QueryContext(ctx, `SELECT name, url FROM book_links WHERE book_id=$1`, id)
 	if err != nil {
-		log.Println("Error getting links:", err)
+		slog.ErrorContext(ctx, "failed to get book links", "error", err)
 		return &b, nil
 	}
 	defer rows.Close()
@@ -58,15 +98,20 @@ func GetBookByID(id int) (*models.Book, error) {
 	for rows.Next() {
 		var link models.Link
 		if err := rows.Scan(&link.Name, &link.Url); err != nil {
-			log.Println("Error scanning link:", err)
+			slog.ErrorContext(ctx, "failed to scan book link", "error", err)
 			continue
 		}
 		b.Links = append(b.Links, link)
 	}
 
 	if err = rows.Err(); err != nil {
-		log.Println("Rows error:", err)
+		slog.ErrorContext(ctx, "failed to read book links", "error", err)
 	}
 
 	return &b, nil
 }
+
+func IsUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
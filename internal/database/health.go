@@ -0,0 +1,20 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// BooksIngestionAge returns how long ago the newest book was stored; ok is
+// false when the table is empty.
+func BooksIngestionAge(ctx context.Context) (age time.Duration, ok bool, err error) {
+	var seconds sql.NullFloat64
+	err = DB.QueryRowContext(ctx,
+		"SELECT EXTRACT(EPOCH FROM localtimestamp - MAX(created_at))::float8 FROM books",
+	).Scan(&seconds)
+	if err != nil || !seconds.Valid {
+		return 0, false, err
+	}
+	return time.Duration(seconds.Float64 * float64(time.Second)), true, nil
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"example.com/m/v2/internal/database"
+	"example.com/m/v2/internal/utils"
+	"github.com/gorilla/mux"
+)
+
+func APIGetBooks(w http.ResponseWriter, r *http.Request) {
+	pageSize := 12
+	if s := r.URL.Query().Get("per_page"); s != "" {
+		if num, err := strconv.Atoi(s); err == nil && num > 0 && num <= 100 {
+			pageSize = num
+		}
+	}
+	page := 1
+	if p := r.URL.Query().Get("page"); p != "" {
+		if num, err := strconv.Atoi(p); err == nil && num > 0 {
+			page = num
+		}
+	}
+
+	total := database.CountBooks(r.Context())
+	books, err := database.ListBooks(r.Context(), pageSize, (page-1)*pageSize)
+	if err != nil {
+		utils.WriteJSONError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"books": books,
+		"page":  page,
+		"pages": int(math.Ceil(float64(total) / float64(pageSize))),
+		"total": total,
+	})
+}
+
+func APIGetBookByID(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.WriteJSONError(w, http.StatusNotFound, "book not found")
+		return
+	}
+
+	book, err := database.GetBookByID(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSONError(w, http.StatusNotFound, "book not found")
+			return
+		}
+		utils.WriteJSONError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, book)
+}
@@ -1,16 +1,18 @@
 package handlers
 
 import (
-	"html/template"
 	"math"
 	"net/http"
 	"strconv"
 
 	"example.com/m/v2/internal/database"
-	"github.com/gorilla/csrf"
+	"example.com/m/v2/internal/views"
 	"github.com/gorilla/mux"
 )
 
+var booksTmpl = views.Must("layout.html", "books.html")
+var bookTmpl = views.Must("layout.html", "book.html")
+
 func GetBooks(w http.ResponseWriter, r *http.Request) {
 	sortBy := r.URL.Query().Get("sort")
 	if sortBy == "" {
@@ -26,7 +28,7 @@ func GetBooks(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var total int
-	err := database.DB.QueryRow("SELECT COUNT(*) FROM books").Scan(&total)
+	err := database.DB.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM books").Scan(&total)
 	if err != nil {
 		http.Error(w, "Error database", http.StatusInternalServerError)
 		return
@@ -34,7 +36,7 @@ func GetBooks(w http.ResponseWriter, r *http.Request) {
 
 	offset := (page - 1) * pageSize
 
-	rows, err := database.DB.Query(`
+	rows, err := database.DB.QueryContext(r.Context(), `
 		SELECT id, title, author, image, publisher, rank
 		FROM books
 		ORDER BY $1 LIMIT $2 OFFSET $3`, sortBy, pageSize, offset)
@@ -62,73 +64,22 @@ func GetBooks(w http.ResponseWriter, r *http.Request) {
 
 	pages := int(math.Ceil(float64(total) / float64(pageSize)))
 
-	userID := r.Context().Value("userID")
-
 	data := struct {
-		Books     interface{}
-		Flash     string
-		SortBy    string
-		User      interface{}
-		CSRFToken string
-		PageCSS   string
-		Page      int
-		Pages     int
+		views.Layout
+		Books   interface{}
+		SortBy  string
+		PageCSS string
+		Page    int
+		Pages   int
 	}{
-		Books:     books,
-		Flash:     "",
-		SortBy:    sortBy,
-		User:      userID,
-		CSRFToken: csrf.Token(r),
-		PageCSS:   "books",
-		Page:      page,
-		Pages:     pages,
+		Books:   books,
+		SortBy:  sortBy,
+		PageCSS: "books",
+		Page:    page,
+		Pages:   pages,
 	}
 
-	tmpl, err := template.New("layout").Funcs(template.FuncMap{
-		"add":   func(a, b int) int { return a + b },
-		"minus": func(a, b int) int { return a - b },
-		"until": func(n int) []int {
-			arr := make([]int, n)
-			for i := range arr {
-				arr[i] = i
-			}
-			return arr
-		},
-		"smartPages": func(current, total int) []int {
-			pages := []int{}
-			start := current - 2
-			end := current + 2
-
-			if start < 1 {
-				start = 1
-				end = 5
-			}
-
-			if end > total {
-				end = total
-				start = total - 3
-				if start < 1 {
-					start = 1
-				}
-			}
-
-			for i := start; i <= end; i++ {
-				pages = append(pages, i)
-			}
-
-			return pages
-		},
-	}).ParseFiles("internal/views/layout.html", "internal/views/books.html")
-	if err != nil {
-		http.Error(w, "Error loading template: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	err = tmpl.Lookup("layout").Execute(w, data)
-	if err != nil {
-		http.Error(w, "Error executing template: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
+	booksTmpl.Render(w, r, &data)
 }
 
 func GetBookByID(w http.ResponseWriter, r *http.Request) {
@@ -139,17 +90,15 @@ func GetBookByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	book, err := database.GetBookByID(id)
+	book, err := database.GetBookByID(r.Context(), id)
 	if err != nil {
 		http.NotFound(w, r)
 		return
 	}
 
-	userID := r.Context().Value("userID")
-
 	data := struct {
+		views.Layout
 		Book        interface{}
-		Flash       string
 		Title       string
 		Image       string
 		Author      string
@@ -157,12 +106,9 @@ func GetBookByID(w http.ResponseWriter, r *http.Request) {
 		Rank        int
 		Description string
 		Links       interface{}
-		User        interface{}
-		CSRFToken   string
 		PageCSS     string
 	}{
 		Book:        book,
-		Flash:       "",
 		Title:       book.Title,
 		Image:       book.Image,
 		Author:      book.Author,
@@ -170,22 +116,10 @@ func GetBookByID(w http.ResponseWriter, r *http.Request) {
 		Rank:        book.Rank,
 		Description: book.Description,
 		Links:       book.Links,
-		User:        userID,
-		CSRFToken:   csrf.Token(r),
 		PageCSS:     "book",
 	}
 
-	tmpl, err := template.ParseFiles("internal/views/layout.html", "internal/views/book.html")
-	if err != nil {
-		http.Error(w, "Error loading template: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	err = tmpl.Lookup("layout").Execute(w, data)
-	if err != nil {
-		http.Error(w, "Error executing template: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
+	bookTmpl.Render(w, r, &data)
 }
 
 func RedirectToLogin(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"example.com/m/v2/internal/middleware"
+)
+
+const maxCSPReportSize = 64 << 10
+
+// CSPReport accepts both the legacy report-uri body ({"csp-report": {...}})
+// and Reporting API batches ([{"type": "csp-violation", "body": {...}}]).
+func CSPReport(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxCSPReportSize))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var reports []map[string]interface{}
+	var legacy struct {
+		Report map[string]interface{} `json:"csp-report"`
+	}
+	var batch []struct {
+		Type string                 `json:"type"`
+		Body map[string]interface{} `json:"body"`
+	}
+	switch {
+	case json.Unmarshal(body, &legacy) == nil && legacy.Report != nil:
+		reports = append(reports, legacy.Report)
+	case json.Unmarshal(body, &batch) == nil:
+		for _, report := range batch {
+			if report.Type == "csp-violation" && report.Body != nil {
+				reports = append(reports, report.Body)
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	for _, report := range reports {
+		slog.WarnContext(r.Context(), "CSP violation",
+			"client_ip", middleware.ClientIP(r),
+			"user_agent", r.UserAgent(),
+			"report", report,
+		)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"example.com/m/v2/internal/config"
+	"example.com/m/v2/internal/database"
+	"example.com/m/v2/internal/services"
+	"example.com/m/v2/internal/utils"
+)
+
+const readinessCheckTimeout = 2 * time.Second
+
+type schemaChecker interface {
+	Check(ctx context.Context) error
+}
+
+var (
+	maxIngestionAge time.Duration
+	schema          schemaChecker
+	draining        atomic.Bool
+)
+
+func InitHealth(cfg config.Health, migrations schemaChecker) {
+	maxIngestionAge = cfg.MaxIngestionAge
+	schema = migrations
+}
+
+// SetDraining makes /readyz fail so that traffic is routed elsewhere while
+// the server finishes in-flight requests.
+func SetDraining() {
+	draining.Store(true)
+}
+
+// Errors are only logged: the endpoint is public and they can reveal
+// internal addresses.
+type checkResult struct {
+	Status     string   `json:"status"`
+	AgeSeconds *float64 `json:"age_seconds,omitempty"`
+	err        error
+}
+
+// Healthz only reports that the process is up and serving.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Readyz runs the dependency checks in parallel and answers 503 when any of
+// them fails or the server is shutting down.
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]func(ctx context.Context) checkResult{
+		"database": func(ctx context.Context) checkResult {
+			return result(database.DB.PingContext(ctx))
+		},
+		"migrations": func(ctx context.Context) checkResult {
+			return result(schema.Check(ctx))
+		},
+		"storage": func(ctx context.Context) checkResult {
+			return result(services.CheckAvatarStorage(ctx))
+		},
+		"ingestion": checkIngestion,
+	}
+
+	results := make(map[string]checkResult, len(checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+			defer cancel()
+			res := check(ctx)
+			if res.err != nil {
+				slog.WarnContext(r.Context(), "readiness check failed", "check", name, "error", res.err)
+			}
+			mu.Lock()
+			results[name] = res
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	status, code := "ok", http.StatusOK
+	for _, res := range results {
+		if res.Status != "ok" {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+	if draining.Load() {
+		status, code = "draining", http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	utils.WriteJSON(w, code, map[string]interface{}{
+		"status": status,
+		"checks": results,
+	})
+}
+
+func checkIngestion(ctx context.Context) checkResult {
+	age, ok, err := database.BooksIngestionAge(ctx)
+	if err != nil {
+		return result(err)
+	}
+	if !ok {
+		return result(errors.New("no books have been ingested"))
+	}
+
+	seconds := age.Seconds()
+	res := checkResult{Status: "ok", AgeSeconds: &seconds}
+	if maxIngestionAge > 0 && age > maxIngestionAge {
+		res.Status = "failing"
+		res.err = fmt.Errorf("last ingestion is older than %s", maxIngestionAge)
+	}
+	return res
+}
+
+func result(err error) checkResult {
+	if err != nil {
+		return checkResult{Status: "failing", err: err}
+	}
+	return checkResult{Status: "ok"}
+}
@@ -0,0 +1,112 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"example.com/m/v2/internal/config"
+)
+
+type contextKey int
+
+const requestKey contextKey = 0
+
+type requestInfo struct {
+	id     string
+	userID atomic.Int64
+}
+
+// Init installs the default slog logger writing to stdout.
+func Init(cfg config.Log) error {
+	return Setup(os.Stdout, cfg.Level, cfg.Format)
+}
+
+func Setup(out io.Writer, level, format string) error {
+	var lvl slog.Level
+	if level == "" {
+		level = "info"
+	}
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "", "json":
+		h = slog.NewJSONHandler(out, opts)
+	case "text":
+		h = slog.NewTextHandler(out, opts)
+	default:
+		return fmt.Errorf("invalid log format %q (use json or text)", format)
+	}
+
+	slog.SetDefault(slog.New(contextHandler{h}))
+	// The standard logger now writes through slog, which adds its own timestamp.
+	log.SetFlags(0)
+	return nil
+}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestKey, &requestInfo{id: id})
+}
+
+func RequestID(ctx context.Context) string {
+	if info, ok := ctx.Value(requestKey).(*requestInfo); ok {
+		return info.id
+	}
+	return ""
+}
+
+// SetUserID records the authenticated user on the request so that log lines
+// written by outer middleware, such as the access log, include it too.
+func SetUserID(ctx context.Context, userID int) {
+	if info, ok := ctx.Value(requestKey).(*requestInfo); ok {
+		info.userID.Store(int64(userID))
+	}
+}
+
+func userID(ctx context.Context) int {
+	if id, ok := ctx.Value("userID").(int); ok {
+		return id
+	}
+	if info, ok := ctx.Value(requestKey).(*requestInfo); ok {
+		return int(info.userID.Load())
+	}
+	return 0
+}
+
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ctx != nil {
+		if id := RequestID(ctx); id != "" {
+			r.AddAttrs(slog.String("request_id", id))
+		}
+		if id := userID(ctx); id != 0 {
+			r.AddAttrs(slog.Int("user_id", id))
+		}
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
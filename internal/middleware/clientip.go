@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"example.com/m/v2/internal/config"
+)
+
+var trustedProxies []netip.Prefix
+
+// proxyHeader is the only forwarding header read. Proxies append to the one
+// they write and pass the other through from the client untouched.
+var proxyHeader = "xff"
+
+// InitTrustedProxies sets the CIDRs or single addresses of reverse proxies
+// allowed to set the forwarding header, and which header that is. With an
+// empty list the headers are ignored.
+func InitTrustedProxies(cfg config.Security) error {
+	if err := SetProxyHeader(cfg.ProxyHeader); err != nil {
+		return err
+	}
+	return SetTrustedProxies(cfg.TrustedProxies)
+}
+
+// SetProxyHeader selects X-Forwarded-For ("xff") or Forwarded ("forwarded").
+func SetProxyHeader(name string) error {
+	switch name {
+	case "xff", "forwarded":
+		proxyHeader = name
+		return nil
+	}
+	return fmt.Errorf("invalid proxy header %q (use xff or forwarded)", name)
+}
+
+func SetTrustedProxies(entries []string) error {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+
+	trustedProxies = prefixes
+	return nil
+}
+
+func isTrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that made the request, without
+// a port. Forwarding headers are walked right to left and only trusted as long
+// as every hop that appended to them is a trusted proxy.
+func ClientIP(r *http.Request) string {
+	peer, ok := parseNodeAddr(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !isTrustedProxy(peer) {
+		return peer.String()
+	}
+
+	hops := forwardedFor(r)
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseNodeAddr(hops[i])
+		if !ok {
+			break
+		}
+		client = addr
+		if !isTrustedProxy(addr) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// forwardedFor lists the client chain from the configured header only.
+func forwardedFor(r *http.Request) []string {
+	var hops []string
+	if proxyHeader == "forwarded" {
+		for _, value := range r.Header.Values("Forwarded") {
+			for _, element := range strings.Split(value, ",") {
+				node := ""
+				for _, pair := range strings.Split(element, ";") {
+					key, val, found := strings.Cut(strings.TrimSpace(pair), "=")
+					if found && strings.EqualFold(key, "for") {
+						node = strings.Trim(val, `"`)
+					}
+				}
+				hops = append(hops, node)
+			}
+		}
+		return hops
+	}
+
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, node := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(node))
+		}
+	}
+	return hops
+}
+
+// parseNodeAddr accepts "ip", "ip:port", "[ipv6]" and "[ipv6]:port".
+func parseNodeAddr(node string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	node = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+
+	addr, err := netip.ParseAddr(node)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
@@ -0,0 +1,167 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     string
+		remoteAddr string
+		xff        []string
+		forwarded  []string
+		want       string
+	}{
+		{
+			name:       "no proxy headers",
+			header:     "xff",
+			remoteAddr: "203.0.113.7:5000",
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "untrusted peer cannot set X-Forwarded-For",
+			header:     "xff",
+			remoteAddr: "198.51.100.1:5000",
+			xff:        []string{"1.2.3.4"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "trusted proxy",
+			header:     "xff",
+			remoteAddr: "10.0.0.1:5000",
+			xff:        []string{"203.0.113.7"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "client-supplied hop left of the real client is ignored",
+			header:     "xff",
+			remoteAddr: "10.0.0.1:5000",
+			xff:        []string{"1.2.3.4, 203.0.113.7"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "chain of trusted proxies",
+			header:     "xff",
+			remoteAddr: "10.0.0.1:5000",
+			xff:        []string{"203.0.113.7", "10.0.0.2"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "spoofed Forwarded is ignored when the proxy writes X-Forwarded-For",
+			header:     "xff",
+			remoteAddr: "10.0.0.1:5000",
+			xff:        []string{"203.0.113.7"},
+			forwarded:  []string{"for=1.2.3.4"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "spoofed X-Forwarded-For is ignored when the proxy writes Forwarded",
+			header:     "forwarded",
+			remoteAddr: "10.0.0.1:5000",
+			xff:        []string{"1.2.3.4"},
+			forwarded:  []string{"for=203.0.113.7;proto=https"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "Forwarded with quoted IPv6 and port",
+			header:     "forwarded",
+			remoteAddr: "10.0.0.1:5000",
+			forwarded:  []string{`for="[2001:db8::1]:4711"`},
+			want:       "2001:db8::1",
+		},
+		{
+			name:       "IPv6 peer with port",
+			header:     "xff",
+			remoteAddr: "[2001:db8::2]:5000",
+			xff:        []string{"1.2.3.4"},
+			want:       "2001:db8::2",
+		},
+		{
+			name:       "bad hop stops the walk at the last trusted address",
+			header:     "xff",
+			remoteAddr: "10.0.0.1:5000",
+			xff:        []string{"not-an-ip"},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "obfuscated Forwarded node is a bad hop",
+			header:     "forwarded",
+			remoteAddr: "10.0.0.1:5000",
+			forwarded:  []string{"for=_hidden"},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "unparseable remote address is returned as is",
+			header:     "xff",
+			remoteAddr: "pipe",
+			xff:        []string{"1.2.3.4"},
+			want:       "pipe",
+		},
+	}
+
+	if err := SetTrustedProxies([]string{"10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		SetTrustedProxies(nil)
+		SetProxyHeader("xff")
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetProxyHeader(tt.header); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			for _, v := range tt.forwarded {
+				r.Header.Add("Forwarded", v)
+			}
+			if got := ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNodeAddr(t *testing.T) {
+	tests := []struct {
+		node string
+		want string
+		ok   bool
+	}{
+		{"203.0.113.7", "203.0.113.7", true},
+		{"203.0.113.7:80", "203.0.113.7", true},
+		{"2001:db8::1", "2001:db8::1", true},
+		{"[2001:db8::1]", "2001:db8::1", true},
+		{"[2001:db8::1]:443", "2001:db8::1", true},
+		{"::ffff:203.0.113.7", "203.0.113.7", true},
+		{"fe80::1%eth0", "fe80::1", true},
+		{"", "", false},
+		{"unknown", "", false},
+		{"_hidden", "", false},
+		{"203.0.113.300", "", false},
+	}
+
+	for _, tt := range tests {
+		addr, ok := parseNodeAddr(tt.node)
+		if ok != tt.ok {
+			t.Errorf("parseNodeAddr(%q) ok = %v, want %v", tt.node, ok, tt.ok)
+			continue
+		}
+		if ok && addr.String() != tt.want {
+			t.Errorf("parseNodeAddr(%q) = %s, want %s", tt.node, addr, tt.want)
+		}
+	}
+}
+
+func TestSetProxyHeaderRejectsUnknown(t *testing.T) {
+	if err := SetProxyHeader("x-real-ip"); err == nil {
+		t.Error("SetProxyHeader accepted an unknown header")
+	}
+}
@@ -1,14 +1,22 @@
 package middleware
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
+	"regexp"
 	"time"
+
+	"example.com/m/v2/internal/database"
+	"example.com/m/v2/internal/logging"
+	"example.com/m/v2/internal/metrics"
+	"example.com/m/v2/internal/models"
+	"example.com/m/v2/internal/utils"
 )
 
 type responseWriter struct {
 	http.ResponseWriter
 	status      int
+	bytes       int
 	wroteHeader bool
 }
 
@@ -34,7 +42,29 @@ func (rw *responseWriter) Write(b []byte) (int, error) {
 	if !rw.wroteHeader {
 		rw.WriteHeader(http.StatusOK)
 	}
-	return rw.ResponseWriter.Write(b)
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += n
+	return n, err
+}
+
+const requestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			var err error
+			if id, err = utils.GenerateToken(16); err != nil {
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
 }
 
 func Logger(next http.Handler) http.Handler {
@@ -44,45 +74,75 @@ func Logger(next http.Handler) http.Handler {
 		wrapped := wrapResponseWriter(w)
 		next.ServeHTTP(wrapped, r)
 
-		log.Printf(
-			"[%s] %s %s %d %s %s",
-			r.Method,
-			r.RequestURI,
-			r.RemoteAddr,
-			wrapped.status,
-			time.Since(start),
-			r.UserAgent(),
+		level := slog.LevelInfo
+		switch {
+		case wrapped.status >= 500:
+			level = slog.LevelError
+		case wrapped.status >= 400:
+			level = slog.LevelWarn
+		}
+
+		slog.LogAttrs(r.Context(), level, "request",
+			slog.String("method", r.Method),
+			// The path only: query strings carry secrets such as email
+			// verification tokens and OIDC codes.
+			slog.String("path", r.URL.Path),
+			slog.String("client_ip", ClientIP(r)),
+			slog.Int("status", wrapped.status),
+			slog.Int("bytes", wrapped.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("user_agent", r.UserAgent()),
 		)
 	})
 }
 
-func SecurityLogger(event string, r *http.Request, details string) {
-	log.Printf(
-		"[SECURITY] %s | IP: %s | URI: %s | User-Agent: %s | Details: %s",
-		event,
-		r.RemoteAddr,
-		r.RequestURI,
-		r.UserAgent(),
-		details,
+type Metadata map[string]interface{}
+
+var loginOutcomes = map[string]string{
+	"LOGIN_SUCCESS":   "success",
+	"LOGIN_FAILED":    "failure",
+	"LOGIN_THROTTLED": "throttled",
+}
+
+func SecurityLogger(event string, r *http.Request, userID int, metadata Metadata) {
+	actorID, _ := r.Context().Value("userID").(int)
+
+	if outcome, ok := loginOutcomes[event]; ok {
+		metrics.Logins.WithLabelValues(outcome).Inc()
+	}
+
+	slog.InfoContext(r.Context(), "security event",
+		slog.String("event", event),
+		slog.Int("subject_id", userID),
+		slog.String("client_ip", ClientIP(r)),
+		slog.String("path", r.URL.Path),
+		slog.String("user_agent", r.UserAgent()),
+		slog.Any("details", map[string]interface{}(metadata)),
 	)
+
+	email, _ := metadata["email"].(string)
+	err := database.InsertAuditEvent(r.Context(), models.AuditEvent{
+		Event:     event,
+		UserID:    userID,
+		UserEmail: email,
+		ActorID:   actorID,
+		IP:        ClientIP(r),
+		UserAgent: r.UserAgent(),
+		Metadata:  metadata,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to save audit event", "event", event, "error", err)
+	}
 }
 
 func LogFailedLogin(r *http.Request, email string) {
-	SecurityLogger("FAILED_LOGIN", r, "Email: "+email)
+	SecurityLogger("LOGIN_FAILED", r, 0, Metadata{"email": email})
 }
 
 func LogSuccessfulLogin(r *http.Request, email string) {
-	log.Printf(
-		"[LOGIN] Successful login | Email: %s | IP: %s",
-		email,
-		r.RemoteAddr,
-	)
+	SecurityLogger("LOGIN_SUCCESS", r, 0, Metadata{"email": email})
 }
 
 func LogRegistration(r *http.Request, email string) {
-	log.Printf(
-		"[REGISTRATION] New user registered | Email: %s | IP: %s",
-		email,
-		r.RemoteAddr,
-	)
+	SecurityLogger("REGISTRATION", r, 0, Metadata{"email": email})
 }
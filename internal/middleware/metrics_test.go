@@ -0,0 +1,20 @@
+package middleware
+
+import "testing"
+
+func TestMethodLabel(t *testing.T) {
+	tests := map[string]string{
+		"GET":     "GET",
+		"POST":    "POST",
+		"OPTIONS": "OPTIONS",
+		"get":     "OTHER",
+		"FOO":     "OTHER",
+		"":        "OTHER",
+		"PROPFIND-aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa": "OTHER",
+	}
+	for method, want := range tests {
+		if got := methodLabel(method); got != want {
+			t.Errorf("methodLabel(%q) = %q, want %q", method, got, want)
+		}
+	}
+}
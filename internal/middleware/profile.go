@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/csrf"
+
+	"example.com/m/v2/internal/config"
+)
+
+const defaultCSRFKey = "32-byte-long-auth-key-change-me!"
+
+// SecurityProfile groups the settings that differ between local HTTP
+// development and an HTTPS deployment.
+type SecurityProfile struct {
+	Name           string
+	SecureCookies  bool
+	TrustedOrigins []string
+	HSTSMaxAge     int
+	CSRFKey        []byte
+}
+
+var profile = SecurityProfile{
+	Name:           "dev",
+	TrustedOrigins: []string{"localhost:8000", "127.0.0.1:8000"},
+	CSRFKey:        []byte(defaultCSRFKey),
+}
+
+// InitSecurityProfile derives the profile from cfg.Env and applies the
+// explicit overrides. The dev profile serves plain HTTP on localhost, prod
+// uses secure cookies, HSTS and the host of the base URL as trusted origin.
+// Config validation already refuses prod with a missing or placeholder key.
+func InitSecurityProfile(cfg *config.Config) error {
+	var p SecurityProfile
+	switch cfg.Env {
+	case "dev":
+		p = SecurityProfile{
+			Name:           "dev",
+			TrustedOrigins: []string{"localhost:8000", "127.0.0.1:8000"},
+		}
+	case "prod":
+		u, err := url.Parse(cfg.BaseURL)
+		if err != nil {
+			return fmt.Errorf("APP_BASE_URL: %w", err)
+		}
+		p = SecurityProfile{
+			Name:           "prod",
+			SecureCookies:  true,
+			TrustedOrigins: []string{u.Host},
+			HSTSMaxAge:     31536000,
+		}
+	default:
+		return fmt.Errorf("unsupported APP_ENV %q (use dev or prod)", cfg.Env)
+	}
+
+	sec := cfg.Security
+	if sec.CookieSecure != nil {
+		p.SecureCookies = *sec.CookieSecure
+	}
+	if sec.TrustedOrigins != nil {
+		p.TrustedOrigins = sec.TrustedOrigins
+	}
+	if sec.HSTSMaxAge != nil {
+		p.HSTSMaxAge = *sec.HSTSMaxAge
+	}
+
+	key := sec.CSRFKey
+	if key == "" {
+		key = defaultCSRFKey
+		slog.Warn("Using default CSRF key. Set CSRF_KEY in production!")
+	}
+	p.CSRFKey = []byte(key)
+
+	if p.Name == "prod" && !p.SecureCookies {
+		slog.Warn("COOKIE_SECURE=false in the prod profile, cookies will be sent over plain HTTP")
+	}
+
+	profile = p
+	return nil
+}
+
+func Profile() SecurityProfile {
+	return profile
+}
+
+// SecureCookies reports whether cookies should carry the Secure attribute.
+func SecureCookies() bool {
+	return profile.SecureCookies
+}
+
+// CSRF builds the gorilla/csrf middleware for the active profile. Without
+// secure cookies the site is served over plain HTTP, so requests are marked
+// as such to skip the HTTPS-only Referer check.
+func CSRF() func(http.Handler) http.Handler {
+	protect := csrf.Protect(
+		profile.CSRFKey,
+		csrf.Secure(profile.SecureCookies),
+		csrf.Path("/"),
+		csrf.SameSite(csrf.SameSiteStrictMode),
+		csrf.TrustedOrigins(profile.TrustedOrigins),
+	)
+	if profile.SecureCookies {
+		return protect
+	}
+	return func(next http.Handler) http.Handler {
+		h := protect(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.ServeHTTP(w, csrf.PlaintextHTTPRequest(r))
+		})
+	}
+}
@@ -1,62 +1,164 @@
 package middleware
 
 import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
 	"net/http"
-	"sync"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/gorilla/mux"
 	"golang.org/x/time/rate"
+
+	"example.com/m/v2/internal/config"
+	"example.com/m/v2/internal/metrics"
 )
 
-type RateLimiter struct {
-	visitors map[string]*rate.Limiter
-	mu       sync.RWMutex
-	rate     rate.Limit
-	burst    int
+type RateLimitPolicy struct {
+	Name    string
+	Rate    rate.Limit
+	Burst   int
+	PerUser bool
+}
+
+var DefaultRateLimitPolicies = map[string]RateLimitPolicy{
+	"default": {Name: "default", Rate: 10, Burst: 20},
+	"auth":    {Name: "auth", Rate: rate.Every(12 * time.Second), Burst: 5},
+	"static":  {Name: "static", Rate: 50, Burst: 100},
+	"api":     {Name: "api", Rate: 2, Burst: 30, PerUser: true},
+}
+
+// LoadRateLimitPolicies starts from DefaultRateLimitPolicies, applies the
+// policies from the config file, then the JSON policy file and then the
+// comma separated list like "auth=5/m:5,api=120/m:30".
+func LoadRateLimitPolicies(cfg config.RateLimit) (map[string]RateLimitPolicy, error) {
+	policies := map[string]RateLimitPolicy{}
+	for name, p := range DefaultRateLimitPolicies {
+		policies[name] = p
+	}
+
+	if err := applyRateLimitPolicies(policies, cfg.Policies); err != nil {
+		return nil, fmt.Errorf("rate_limit.policies: %w", err)
+	}
+
+	if path := cfg.File; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var file map[string]config.RateLimitPolicy
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if err := applyRateLimitPolicies(policies, file); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if spec := cfg.Limits; spec != "" {
+		for _, entry := range strings.Split(spec, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			rateSpec, burstSpec, ok2 := strings.Cut(value, ":")
+			burst, err := strconv.Atoi(burstSpec)
+			if !ok || !ok2 || err != nil {
+				return nil, fmt.Errorf("RATE_LIMITS: entry %q must look like name=10/s:20", entry)
+			}
+			p := policies[name]
+			p.Name = name
+			if err := p.set(rateSpec, burst); err != nil {
+				return nil, fmt.Errorf("RATE_LIMITS: policy %q: %w", name, err)
+			}
+			policies[name] = p
+		}
+	}
+
+	for _, name := range []string{"default", "auth", "static", "api"} {
+		if _, ok := policies[name]; !ok {
+			return nil, fmt.Errorf("rate limit policy %q is not defined", name)
+		}
+	}
+	return policies, nil
 }
 
-func NewRateLimiter(r rate.Limit, b int) *RateLimiter {
-	return &RateLimiter{
-		visitors: make(map[string]*rate.Limiter),
-		rate:     r,
-		burst:    b,
+func applyRateLimitPolicies(policies map[string]RateLimitPolicy, entries map[string]config.RateLimitPolicy) error {
+	for name, entry := range entries {
+		p := policies[name]
+		p.Name = name
+		if err := p.set(entry.Rate, entry.Burst); err != nil {
+			return fmt.Errorf("policy %q: %w", name, err)
+		}
+		if entry.PerUser != nil {
+			p.PerUser = *entry.PerUser
+		}
+		policies[name] = p
 	}
+	return nil
 }
 
-func (rl *RateLimiter) GetLimiter(ip string) *rate.Limiter {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
+func (p *RateLimitPolicy) set(rateSpec string, burst int) error {
+	count, per, ok := strings.Cut(rateSpec, "/")
+	n, err := strconv.ParseFloat(count, 64)
+	if !ok || err != nil || n <= 0 {
+		return fmt.Errorf("invalid rate %q, use <count>/s, /m or /h", rateSpec)
+	}
 
-	limiter, exists := rl.visitors[ip]
-	if !exists {
-		limiter = rate.NewLimiter(rl.rate, rl.burst)
-		rl.visitors[ip] = limiter
+	var window time.Duration
+	switch per {
+	case "s":
+		window = time.Second
+	case "m":
+		window = time.Minute
+	case "h":
+		window = time.Hour
+	default:
+		return fmt.Errorf("invalid rate %q, use <count>/s, /m or /h", rateSpec)
+	}
+	if burst < 1 {
+		return fmt.Errorf("burst must be at least 1")
 	}
 
-	return limiter
+	p.Rate = rate.Limit(n / window.Seconds())
+	p.Burst = burst
+	return nil
+}
+
+type RateLimiter struct {
+	store  RateLimitStore
+	policy RateLimitPolicy
+}
+
+func NewRateLimiter(policy RateLimitPolicy, store RateLimitStore) *RateLimiter {
+	return &RateLimiter{store: store, policy: policy}
 }
 
-func (rl *RateLimiter) CleanupVisitors() {
-	ticker := time.NewTicker(5 * time.Minute)
-	go func() {
-		for range ticker.C {
-			rl.mu.Lock()
-			rl.visitors = make(map[string]*rate.Limiter)
-			rl.mu.Unlock()
+func (rl *RateLimiter) key(r *http.Request) string {
+	if rl.policy.PerUser {
+		if userID, ok := r.Context().Value("userID").(int); ok {
+			return rl.policy.Name + ":user:" + strconv.Itoa(userID)
 		}
-	}()
+	}
+	return rl.policy.Name + ":ip:" + ClientIP(r)
 }
 
 func (rl *RateLimiter) RateLimit(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		ip := r.RemoteAddr
-		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-			ip = forwarded
+		res, err := rl.store.Take(r.Context(), rl.key(r), rl.policy)
+		if err != nil {
+			// Fail open: an unavailable store must not take the site down.
+			slog.ErrorContext(r.Context(), "rate limit store unavailable", "policy", rl.policy.Name, "error", err)
+			next.ServeHTTP(w, r)
+			return
 		}
+		rl.setHeaders(w, res.Remaining)
 
-		limiter := rl.GetLimiter(ip)
-		if !limiter.Allow() {
+		if !res.Allowed {
+			metrics.RateLimitRejections.WithLabelValues(rl.policy.Name).Inc()
+			retryAfter := (1 - res.Remaining) / float64(rl.policy.Rate)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter))))
 			http.Error(w, "Too many requests. Please try again later.", http.StatusTooManyRequests)
 			return
 		}
@@ -64,3 +166,30 @@ func (rl *RateLimiter) RateLimit(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// setHeaders writes the IETF RateLimit fields. The window is the time an
+// empty bucket needs to refill completely.
+func (rl *RateLimiter) setHeaders(w http.ResponseWriter, remaining float64) {
+	remaining = math.Max(0, remaining)
+	window := float64(rl.policy.Burst) / float64(rl.policy.Rate)
+
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(rl.policy.Burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(int(remaining)))
+	h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(refillTime(rl.policy, remaining).Seconds()))))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;name=%q", rl.policy.Burst, int(math.Ceil(window)), rl.policy.Name))
+}
+
+// RouteRateLimit limits each request with the limiter choose picks for the
+// matched mux route template and method; nil means no limit.
+func RouteRateLimit(router *mux.Router, choose func(route, method string) *RateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if rl := choose(routeTemplate(router, r), r.Method); rl != nil {
+				rl.RateLimit(next).ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
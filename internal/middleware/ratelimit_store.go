@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"example.com/m/v2/internal/config"
+	"example.com/m/v2/internal/database"
+)
+
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining float64
+}
+
+// RateLimitStore keeps token buckets. Take refills the bucket for key,
+// consumes one token if available and reports what is left.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, policy RateLimitPolicy) (RateLimitResult, error)
+	Cleanup(ctx context.Context) error
+}
+
+// NewRateLimitStore picks the configured store: memory (the default, per
+// process) or postgres (shared by all replicas).
+func NewRateLimitStore(cfg config.RateLimit) (RateLimitStore, error) {
+	switch kind := cfg.Store; kind {
+	case "", "memory":
+		return NewMemoryRateLimitStore(), nil
+	case "postgres":
+		return PostgresRateLimitStore{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported RATE_LIMIT_STORE %q (use memory or postgres)", kind)
+	}
+}
+
+// StartRateLimitCleanup evicts expired buckets every interval until ctx is
+// done. The returned channel is closed once the cleanup has stopped.
+func StartRateLimitCleanup(ctx context.Context, store RateLimitStore, interval time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := store.Cleanup(context.Background()); err != nil {
+					slog.Error("failed to clean up rate limit buckets", "error", err)
+				}
+			}
+		}
+	}()
+	return done
+}
+
+type memoryBucket struct {
+	limiter   *rate.Limiter
+	expiresAt time.Time
+}
+
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: make(map[string]*memoryBucket)}
+}
+
+func (s *MemoryRateLimitStore) Take(_ context.Context, key string, policy RateLimitPolicy) (RateLimitResult, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{limiter: rate.NewLimiter(policy.Rate, policy.Burst)}
+		s.buckets[key] = b
+	}
+
+	allowed := b.limiter.AllowN(now, 1)
+	remaining := b.limiter.TokensAt(now)
+	// Once the bucket has refilled it is indistinguishable from a new one.
+	b.expiresAt = now.Add(refillTime(policy, remaining))
+	return RateLimitResult{Allowed: allowed, Remaining: remaining}, nil
+}
+
+func (s *MemoryRateLimitStore) Cleanup(_ context.Context) error {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, b := range s.buckets {
+		if now.After(b.expiresAt) {
+			delete(s.buckets, key)
+		}
+	}
+	return nil
+}
+
+type PostgresRateLimitStore struct{}
+
+func (PostgresRateLimitStore) Take(ctx context.Context, key string, policy RateLimitPolicy) (RateLimitResult, error) {
+	var res RateLimitResult
+	err := database.DB.QueryRowContext(ctx,
+		"SELECT allowed, remaining FROM rate_limit_take($1, $2, $3)",
+		key, float64(policy.Rate), policy.Burst,
+	).Scan(&res.Allowed, &res.Remaining)
+	return res, err
+}
+
+func (PostgresRateLimitStore) Cleanup(ctx context.Context) error {
+	_, err := database.DB.ExecContext(ctx, "DELETE FROM rate_limit_buckets WHERE expires_at < now()")
+	return err
+}
+
+func refillTime(policy RateLimitPolicy, remaining float64) time.Duration {
+	return time.Duration((float64(policy.Burst) - remaining) / float64(policy.Rate) * float64(time.Second))
+}
@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestMemoryRateLimitStoreTake(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	policy := RateLimitPolicy{Name: "test", Rate: rate.Every(time.Minute), Burst: 2}
+	ctx := context.Background()
+
+	for i, want := range []bool{true, true, false} {
+		res, err := store.Take(ctx, "k", policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Allowed != want {
+			t.Fatalf("take %d: allowed = %v, want %v", i+1, res.Allowed, want)
+		}
+	}
+
+	// Buckets are per key.
+	if res, _ := store.Take(ctx, "other", policy); !res.Allowed || int(res.Remaining) != 1 {
+		t.Errorf("other key: %+v, want allowed with 1 remaining", res)
+	}
+}
+
+func TestMemoryRateLimitStoreCleanup(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	ctx := context.Background()
+	fast := RateLimitPolicy{Name: "fast", Rate: 1000, Burst: 1}
+	slow := RateLimitPolicy{Name: "slow", Rate: rate.Every(time.Hour), Burst: 1}
+
+	store.Take(ctx, "fast", fast)
+	store.Take(ctx, "slow", slow)
+	// A partly drained bucket lives until it has refilled.
+	store.Take(ctx, "idle", RateLimitPolicy{Name: "idle", Rate: rate.Every(time.Hour), Burst: 5})
+	store.Take(ctx, "idle", RateLimitPolicy{Name: "idle", Rate: rate.Every(time.Hour), Burst: 5})
+
+	time.Sleep(10 * time.Millisecond)
+	if err := store.Cleanup(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := store.buckets["fast"]; ok {
+		t.Errorf("refilled bucket was not evicted")
+	}
+	if _, ok := store.buckets["slow"]; !ok {
+		t.Errorf("bucket still refilling was evicted")
+	}
+	if _, ok := store.buckets["idle"]; !ok {
+		t.Errorf("partly drained bucket was evicted")
+	}
+
+	// After eviction the key starts with a full bucket, as if never seen.
+	if res, _ := store.Take(ctx, "fast", fast); !res.Allowed {
+		t.Errorf("evicted key was limited")
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	rl := NewRateLimiter(RateLimitPolicy{Name: "test", Rate: rate.Every(time.Minute), Burst: 2}, NewMemoryRateLimitStore())
+	h := rl.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		status     int
+		remaining  string
+		reset      string
+		retryAfter string
+	}{
+		{http.StatusOK, "1", "60", ""},
+		{http.StatusOK, "0", "120", ""},
+		{http.StatusTooManyRequests, "0", "120", "60"},
+	}
+	for i, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+		if rec.Code != tt.status {
+			t.Fatalf("request %d: status = %d, want %d", i+1, rec.Code, tt.status)
+		}
+		for name, want := range map[string]string{
+			"RateLimit-Limit":     "2",
+			"RateLimit-Remaining": tt.remaining,
+			"RateLimit-Reset":     tt.reset,
+			"RateLimit-Policy":    `2;w=120;name="test"`,
+			"Retry-After":         tt.retryAfter,
+		} {
+			if got := rec.Header().Get(name); got != want {
+				t.Errorf("request %d: %s = %q, want %q", i+1, name, got, want)
+			}
+		}
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Take(context.Context, string, RateLimitPolicy) (RateLimitResult, error) {
+	return RateLimitResult{}, errors.New("store down")
+}
+
+func (failingStore) Cleanup(context.Context) error { return nil }
+
+func TestRateLimitFailsOpen(t *testing.T) {
+	rl := NewRateLimiter(RateLimitPolicy{Name: "test", Rate: 1, Burst: 1}, failingStore{})
+	rec := httptest.NewRecorder()
+	rl.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("status = %d, headers = %v; want the request through without rate limit headers", rec.Code, rec.Header())
+	}
+}
@@ -0,0 +1,119 @@
+package migrate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"example.com/m/v2/migrations"
+)
+
+func file(content string) *fstest.MapFile {
+	return &fstest.MapFile{Data: []byte(content)}
+}
+
+func TestNewParsesMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"002_add_avatar.up.sql":   file("ALTER TABLE users ADD avatar TEXT;"),
+		"002_add_avatar.down.sql": file("ALTER TABLE users DROP avatar;"),
+		"001_init.sql":            file("CREATE TABLE users ();"),
+		"010_tenth.sql":           file("SELECT 10;"),
+		"migrations.go":           file("package migrations"),
+		"README.md":               file("notes"),
+		"003_dir.sql/nested.sql":  file("SELECT 3;"),
+	}
+
+	m, err := New(nil, fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		version  int64
+		name     string
+		up, down string
+	}{
+		{1, "init", "CREATE TABLE users ();", ""},
+		{2, "add_avatar", "ALTER TABLE users ADD avatar TEXT;", "ALTER TABLE users DROP avatar;"},
+		{10, "tenth", "SELECT 10;", ""},
+	}
+	if len(m.migrations) != len(want) {
+		t.Fatalf("got %d migrations, want %d: %+v", len(m.migrations), len(want), m.migrations)
+	}
+	for i, w := range want {
+		got := m.migrations[i]
+		if got.Version != w.version || got.Name != w.name || got.Up != w.up || got.Down != w.down {
+			t.Errorf("migration %d = %+v, want %+v", i, got, w)
+		}
+		sum := sha256.Sum256([]byte(w.up))
+		if got.Checksum != hex.EncodeToString(sum[:]) {
+			t.Errorf("migration %d checksum is not the sha256 of the up file", w.version)
+		}
+	}
+}
+
+func TestNewRejectsInvalidSets(t *testing.T) {
+	tests := []struct {
+		name    string
+		fsys    fstest.MapFS
+		wantErr string
+	}{
+		{
+			name: "plain and .up.sql for one version",
+			fsys: fstest.MapFS{
+				"001_init.sql":    file("SELECT 1;"),
+				"001_init.up.sql": file("SELECT 1;"),
+			},
+			wantErr: "defined twice",
+		},
+		{
+			name: "two names for one version",
+			fsys: fstest.MapFS{
+				"001_init.sql":  file("SELECT 1;"),
+				"001_other.sql": file("SELECT 1;"),
+			},
+			wantErr: "two names",
+		},
+		{
+			name: "same version with different padding",
+			fsys: fstest.MapFS{
+				"1_init.sql":   file("SELECT 1;"),
+				"001_init.sql": file("SELECT 1;"),
+			},
+			wantErr: "defined twice",
+		},
+		{
+			name: "down file only",
+			fsys: fstest.MapFS{
+				"001_init.sql":        file("SELECT 1;"),
+				"002_orphan.down.sql": file("SELECT 2;"),
+			},
+			wantErr: "down file only",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(nil, tt.fsys)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("New() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestShippedMigrationsParse(t *testing.T) {
+	m, err := New(nil, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, mig := range m.migrations {
+		if mig.Version != int64(i+1) {
+			t.Errorf("migration %d_%s breaks the numbering, want version %d", mig.Version, mig.Name, i+1)
+		}
+		if mig.Down == "" {
+			t.Errorf("migration %d_%s has no down file", mig.Version, mig.Name)
+		}
+	}
+}
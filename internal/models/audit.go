@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+type AuditEvent struct {
+	ID         int64                  `json:"id"`
+	Event      string                 `json:"event"`
+	UserID     int                    `json:"user_id,omitempty"`
+	UserEmail  string                 `json:"user_email,omitempty"`
+	ActorID    int                    `json:"actor_id,omitempty"`
+	ActorEmail string                 `json:"actor_email,omitempty"`
+	IP         string                 `json:"ip"`
+	UserAgent  string                 `json:"user_agent"`
+	Metadata   map[string]interface{} `json:"metadata"`
+	CreatedAt  time.Time              `json:"created_at"`
+}
+
+type AuditFilter struct {
+	Event  string
+	UserID int
+	Email  string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+	Offset int
+}
@@ -1,20 +1,20 @@
 package models
 
 type Link struct {
-	Name string
-	Url  string
+	Name string `json:"name"`
+	Url  string `json:"url"`
 }
 
 type Book struct {
-	ID          int
-	Title       string
-	Author      string
-	Description string
-	Publisher   string
-	Image       string
-	AmazonURL   string
-	Rank        int
-	Links       []Link
+	ID          int    `json:"id"`
+	Title       string `json:"title"`
+	Author      string `json:"author"`
+	Description string `json:"description"`
+	Publisher   string `json:"publisher"`
+	Image       string `json:"image"`
+	AmazonURL   string `json:"amazon_url"`
+	Rank        int    `json:"rank"`
+	Links       []Link `json:"links,omitempty"`
 }
 
 type NYTResponse struct {
@@ -2,27 +2,35 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"mime/multipart"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/cloudinary/cloudinary-go/v2"
 	"github.com/cloudinary/cloudinary-go/v2/api/uploader"
+
+	"example.com/m/v2/internal/config"
+	"example.com/m/v2/internal/tracing"
 )
 
 var cld *cloudinary.Cloudinary
 var useCloudinary bool
 
-func InitCloudinary() error {
-	cloudName := os.Getenv("CLOUDINARY_CLOUD_NAME")
-	apiKey := os.Getenv("CLOUDINARY_API_KEY")
-	apiSecret := os.Getenv("CLOUDINARY_API_SECRET")
+var avatarHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+var ErrExternalAvatar = errors.New("avatar is not stored by this service")
 
-	if cloudName == "" || apiKey == "" || apiSecret == "" {
-		log.Println("Cloudinary not configured - using local storage for avatars")
+func InitCloudinary(cfg config.Cloudinary) error {
+	if !cfg.Enabled() {
+		slog.Info("Cloudinary not configured, using local storage for avatars")
 		useCloudinary = false
 
 		if err := os.MkdirAll("uploads/avatars", 0755); err != nil {
@@ -32,9 +40,9 @@ func InitCloudinary() error {
 	}
 
 	var err error
-	cld, err = cloudinary.NewFromParams(cloudName, apiKey, apiSecret)
+	cld, err = cloudinary.NewFromParams(cfg.CloudName, cfg.APIKey, cfg.APISecret)
 	if err != nil {
-		log.Printf("Failed to initialize Cloudinary: %v - falling back to local storage", err)
+		slog.Warn("failed to initialize Cloudinary, falling back to local storage", "error", err)
 		useCloudinary = false
 		if err := os.MkdirAll("uploads/avatars", 0755); err != nil {
 			return fmt.Errorf("failed to create uploads directory: %w", err)
@@ -43,19 +51,53 @@ func InitCloudinary() error {
 	}
 
 	useCloudinary = true
-	log.Printf("— Cloudinary initialized successfully (cloud: %s)", cloudName)
+	slog.Info("Cloudinary initialized", "cloud", cfg.CloudName)
 	return nil
 }
 
-func UploadAvatar(file multipart.File, userID int) (string, error) {
+// The Admin API allows a few hundred calls per hour, so probes reuse the
+// last ping result for a minute.
+const storagePingTTL = time.Minute
+
+var storagePing struct {
+	sync.Mutex
+	at  time.Time
+	err error
+}
+
+// CheckAvatarStorage verifies that avatars can be stored: Cloudinary answers
+// a ping, or the local uploads directory exists and is writable.
+func CheckAvatarStorage(ctx context.Context) error {
 	if useCloudinary && cld != nil {
-		return uploadToCloudinary(file, userID)
+		storagePing.Lock()
+		defer storagePing.Unlock()
+		if time.Since(storagePing.at) < storagePingTTL {
+			return storagePing.err
+		}
+		_, err := cld.Admin.Ping(ctx)
+		storagePing.at, storagePing.err = time.Now(), err
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Join("uploads", "avatars"), ".readyz-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func UploadAvatar(ctx context.Context, file multipart.File, userID int) (string, error) {
+	if useCloudinary && cld != nil {
+		return uploadToCloudinary(ctx, file, userID)
 	}
 	return uploadToLocal(file, userID)
 }
 
-func uploadToCloudinary(file multipart.File, userID int) (string, error) {
-	ctx := context.Background()
+func uploadToCloudinary(ctx context.Context, file multipart.File, userID int) (url string, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "cloudinary.upload")
+	defer func() { tracing.End(span, err) }()
+
 	publicID := fmt.Sprintf("user_%d", userID)
 
 	overwrite := true
@@ -90,3 +132,45 @@ func uploadToLocal(file io.Reader, userID int) (string, error) {
 
 	return fmt.Sprintf("/uploads/avatars/%s", filename), nil
 }
+
+func DeleteAvatar(ctx context.Context, userID int) error {
+	if useCloudinary && cld != nil {
+		_, err := cld.Upload.Destroy(ctx, uploader.DestroyParams{
+			PublicID: fmt.Sprintf("avatars/user_%d", userID),
+		})
+		if err != nil {
+			return fmt.Errorf("cloudinary delete failed: %w", err)
+		}
+		return nil
+	}
+
+	err := os.Remove(filepath.Join("uploads", "avatars", fmt.Sprintf("user_%d.jpg", userID)))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	return nil
+}
+
+func OpenAvatar(ctx context.Context, avatarURL string) (io.ReadCloser, error) {
+	if strings.HasPrefix(avatarURL, "/uploads/avatars/") {
+		return os.Open(filepath.Join("uploads", "avatars", filepath.Base(avatarURL)))
+	}
+
+	if !strings.HasPrefix(avatarURL, "https://res.cloudinary.com/") {
+		return nil, ErrExternalAvatar
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, avatarURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := avatarHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download avatar: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download avatar: status %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,86 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+
+	"example.com/m/v2/internal/config"
+)
+
+type Mailer interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// logMailer stands in for SMTP in development. Bodies carry verification
+// and reset tokens, so they are only logged at debug level.
+type logMailer struct{}
+
+func (logMailer) Send(ctx context.Context, to, subject, body string) error {
+	slog.InfoContext(ctx, "email not sent, SMTP is not configured", "to", to, "subject", subject)
+	slog.DebugContext(ctx, "unsent email body", "to", to, "body", body)
+	return nil
+}
+
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func (m *smtpMailer) Send(ctx context.Context, to, subject, body string) error {
+	msg := strings.Join([]string{
+		"From: " + m.from,
+		"To: " + to,
+		"Subject: " + subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")
+
+	if err := smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg)); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	slog.DebugContext(ctx, "email sent", "to", to, "subject", subject)
+	return nil
+}
+
+var mailer Mailer = logMailer{}
+
+func InitMailer(cfg config.SMTP) error {
+	if cfg.Host == "" {
+		slog.Info("SMTP not configured, emails will be written to the log (bodies at debug level)")
+		mailer = logMailer{}
+		return nil
+	}
+
+	if cfg.From == "" {
+		return fmt.Errorf("SMTP_FROM is required when SMTP_HOST is set")
+	}
+
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+
+	mailer = &smtpMailer{
+		addr: net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		auth: auth,
+		from: cfg.From,
+	}
+	slog.Info("SMTP mailer initialized", "host", cfg.Host, "port", cfg.Port)
+	return nil
+}
+
+func SetMailer(m Mailer) {
+	mailer = m
+}
+
+func SendEmail(ctx context.Context, to, subject, body string) error {
+	return mailer.Send(ctx, to, subject, body)
+}
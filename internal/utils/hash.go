@@ -2,12 +2,9 @@ package utils
 
 import (
 	"html"
-	"os"
 	"regexp"
 	"strings"
-	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -21,23 +18,17 @@ func CheckPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
-var jwtSecret = []byte(os.Getenv("JWT_SECRET"))
-
-func CreateJWT(userID int) (string, error) {
-	claims := jwt.MapClaims{
-		"sub": userID,
-		"exp": time.Now().Add(24 * time.Hour).Unix(),
-		"iat": time.Now().Unix(),
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
-}
-
 func SanitizeInput(input string) string {
 	sanitized := html.EscapeString(strings.TrimSpace(input))
 	return sanitized
 }
 
+// NormalizeEmail sanitizes an address and lowercases it, the form every
+// email is stored and looked up in.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(SanitizeInput(email))
+}
+
 func IsValidEmail(email string) bool {
 	emailRegex := regexp.MustCompile(`^[a-zA-Z0-9._%+\-]+@[a-zA-Z0-9.\-]+\.[a-zA-Z]{2,}$`)
 	return emailRegex.MatchString(email)
@@ -0,0 +1,224 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"example.com/m/v2/internal/config"
+)
+
+const (
+	legacyKeyID     = "default"
+	minSecretLength = 32
+	minRSAKeyBits   = 2048
+)
+
+var weakSecrets = map[string]bool{
+	"your_jwt_secret": true,
+	"secret":          true,
+	"changeme":        true,
+}
+
+type jwtKey struct {
+	id        string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+var (
+	jwtKeys      map[string]*jwtKey
+	jwtActiveKey *jwtKey
+)
+
+func InitJWTKeys(cfg config.JWT) error {
+	keys := map[string]*jwtKey{}
+	var order []string
+
+	spec := strings.TrimSpace(cfg.Keys)
+	if spec == "" {
+		key, err := newHMACKey(legacyKeyID, cfg.Secret)
+		if err != nil {
+			return fmt.Errorf("JWT_SECRET: %w", err)
+		}
+		keys[key.id] = key
+		order = append(order, key.id)
+	} else {
+		for _, entry := range strings.Split(spec, ",") {
+			parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+			if len(parts) != 3 || parts[0] == "" {
+				return fmt.Errorf("JWT_KEYS: entry %q must look like kid:alg:value", entry)
+			}
+
+			key, err := newJWTKey(parts[0], strings.ToUpper(parts[1]), parts[2])
+			if err != nil {
+				return fmt.Errorf("JWT_KEYS: key %q: %w", parts[0], err)
+			}
+			if _, exists := keys[key.id]; exists {
+				return fmt.Errorf("JWT_KEYS: duplicate key id %q", key.id)
+			}
+			keys[key.id] = key
+			order = append(order, key.id)
+		}
+	}
+
+	activeID := cfg.ActiveKID
+	if activeID == "" {
+		activeID = order[0]
+	}
+	active, ok := keys[activeID]
+	if !ok {
+		return fmt.Errorf("JWT_ACTIVE_KID %q is not defined in JWT_KEYS", activeID)
+	}
+	if active.signKey == nil {
+		return fmt.Errorf("active JWT key %q has no private key and cannot sign tokens", activeID)
+	}
+
+	jwtKeys = keys
+	jwtActiveKey = active
+	return nil
+}
+
+func newJWTKey(id, alg, value string) (*jwtKey, error) {
+	switch alg {
+	case "HS256":
+		return newHMACKey(id, value)
+	case "EDDSA":
+		pem, err := os.ReadFile(value)
+		if err != nil {
+			return nil, err
+		}
+		key := &jwtKey{id: id, method: jwt.SigningMethodEdDSA}
+		if priv, err := jwt.ParseEdPrivateKeyFromPEM(pem); err == nil {
+			key.signKey = priv
+			key.verifyKey = priv.(ed25519.PrivateKey).Public()
+			return key, nil
+		}
+		pub, err := jwt.ParseEdPublicKeyFromPEM(pem)
+		if err != nil {
+			return nil, fmt.Errorf("%s does not contain an Ed25519 key", value)
+		}
+		key.verifyKey = pub
+		return key, nil
+	case "RS256":
+		pem, err := os.ReadFile(value)
+		if err != nil {
+			return nil, err
+		}
+		key := &jwtKey{id: id, method: jwt.SigningMethodRS256}
+		var pub *rsa.PublicKey
+		if priv, err := jwt.ParseRSAPrivateKeyFromPEM(pem); err == nil {
+			key.signKey = priv
+			pub = &priv.PublicKey
+		} else if pub, err = jwt.ParseRSAPublicKeyFromPEM(pem); err != nil {
+			return nil, fmt.Errorf("%s does not contain an RSA key", value)
+		}
+		if pub.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA key must be at least %d bits", minRSAKeyBits)
+		}
+		key.verifyKey = pub
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q (use HS256, EdDSA or RS256)", alg)
+	}
+}
+
+func newHMACKey(id, secret string) (*jwtKey, error) {
+	if secret == "" {
+		return nil, errors.New("secret is empty")
+	}
+	if len(secret) < minSecretLength || weakSecrets[strings.ToLower(secret)] {
+		return nil, fmt.Errorf("secret is too weak, use at least %d random characters", minSecretLength)
+	}
+	return &jwtKey{id: id, method: jwt.SigningMethodHS256, signKey: []byte(secret), verifyKey: []byte(secret)}, nil
+}
+
+func signJWT(claims jwt.MapClaims) (string, error) {
+	if jwtActiveKey == nil {
+		return "", errors.New("JWT keys are not initialized")
+	}
+	token := jwt.NewWithClaims(jwtActiveKey.method, claims)
+	token.Header["kid"] = jwtActiveKey.id
+	return token.SignedString(jwtActiveKey.signKey)
+}
+
+func ParseJWT(tokenStr string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			kid = legacyKeyID
+		}
+		key, ok := jwtKeys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.verifyKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	return token.Claims.(jwt.MapClaims), nil
+}
+
+// CreateJWT issues a session token. version is the user's session version;
+// bumping it in the database ends every session issued before.
+func CreateJWT(userID, version int) (string, error) {
+	return signJWT(jwt.MapClaims{
+		"sub": userID,
+		"ver": version,
+		"exp": time.Now().Add(24 * time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+	})
+}
+
+// CreateReauthJWT proves a passwordless user signed in again with their
+// identity provider a moment ago.
+func CreateReauthJWT(userID int) (string, error) {
+	return signJWT(jwt.MapClaims{
+		"sub":     userID,
+		"exp":     time.Now().Add(10 * time.Minute).Unix(),
+		"iat":     time.Now().Unix(),
+		"purpose": "reauth",
+	})
+}
+
+func CreateTwoFactorJWT(userID int, remember bool) (string, error) {
+	return signJWT(jwt.MapClaims{
+		"sub":      userID,
+		"exp":      time.Now().Add(5 * time.Minute).Unix(),
+		"iat":      time.Now().Unix(),
+		"purpose":  "2fa",
+		"remember": remember,
+	})
+}
+
+// CreateOIDCStateJWT carries the flow's secrets to the callback. reauthUserID
+// is set when a signed-in user confirms their identity, zero for a sign in.
+func CreateOIDCStateJWT(provider, state, nonce, verifier string, reauthUserID int) (string, error) {
+	claims := jwt.MapClaims{
+		"exp":      time.Now().Add(10 * time.Minute).Unix(),
+		"iat":      time.Now().Unix(),
+		"purpose":  "oidc",
+		"provider": provider,
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+	}
+	if reauthUserID != 0 {
+		claims["reauth"] = reauthUserID
+	}
+	return signJWT(claims)
+}
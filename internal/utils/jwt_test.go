@@ -0,0 +1,236 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"example.com/m/v2/internal/config"
+)
+
+const (
+	secretA = "first-secret-that-is-long-enough-00"
+	secretB = "second-secret-that-is-long-enough-0"
+)
+
+func writePEM(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), strings.ReplaceAll(strings.ToLower(blockType), " ", "-")+".pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func initKeys(t *testing.T, cfg config.JWT) {
+	t.Helper()
+	if err := InitJWTKeys(cfg); err != nil {
+		t.Fatalf("InitJWTKeys: %v", err)
+	}
+}
+
+func signWith(t *testing.T, method jwt.SigningMethod, kid string, key interface{}) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, jwt.MapClaims{"sub": 1, "exp": time.Now().Add(time.Minute).Unix()})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestParseJWTLooksUpKeyByKID(t *testing.T) {
+	initKeys(t, config.JWT{Keys: "a:HS256:" + secretA + ",b:HS256:" + secretB, ActiveKID: "b"})
+	fromB, err := CreateJWT(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotating the active key keeps tokens from the old one valid.
+	initKeys(t, config.JWT{Keys: "a:HS256:" + secretA + ",b:HS256:" + secretB, ActiveKID: "a"})
+	if _, err := ParseJWT(fromB); err != nil {
+		t.Errorf("token signed with b after rotating to a: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"known kid", signWith(t, jwt.SigningMethodHS256, "a", []byte(secretA)), true},
+		{"kid names another key", signWith(t, jwt.SigningMethodHS256, "b", []byte(secretA)), false},
+		{"unknown kid", signWith(t, jwt.SigningMethodHS256, "c", []byte(secretA)), false},
+		{"no kid without a legacy key", signWith(t, jwt.SigningMethodHS256, "", []byte(secretA)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseJWT(tt.token)
+			if (err == nil) != tt.ok {
+				t.Errorf("ParseJWT error = %v, want ok = %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseJWTAcceptsLegacyTokensWithoutKID(t *testing.T) {
+	initKeys(t, config.JWT{Secret: secretA})
+	if _, err := ParseJWT(signWith(t, jwt.SigningMethodHS256, "", []byte(secretA))); err != nil {
+		t.Errorf("token without kid under JWT_SECRET: %v", err)
+	}
+}
+
+func TestParseJWTRejectsAlgorithmMismatch(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPath := writePEM(t, "PUBLIC KEY", pubDER)
+	privPath := writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(priv))
+	initKeys(t, config.JWT{Keys: "rsa:RS256:" + privPath + ",hmac:HS256:" + secretA})
+
+	pubPEM, err := os.ReadFile(pubPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		// The classic confusion: an HMAC token keyed with the public RSA key.
+		{"HS256 under an RS256 kid", signWith(t, jwt.SigningMethodHS256, "rsa", pubPEM)},
+		{"RS256 under an HS256 kid", signWith(t, jwt.SigningMethodRS256, "hmac", priv)},
+		{"alg none", signWith(t, jwt.SigningMethodNone, "hmac", jwt.UnsafeAllowNoneSignatureType)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseJWT(tt.token); err == nil {
+				t.Errorf("ParseJWT accepted a token with a mismatched algorithm")
+			}
+		})
+	}
+
+	if _, err := ParseJWT(signWith(t, jwt.SigningMethodRS256, "rsa", priv)); err != nil {
+		t.Errorf("valid RS256 token: %v", err)
+	}
+}
+
+func TestInitJWTKeysRefusesWeakSecrets(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.JWT
+	}{
+		{"empty", config.JWT{}},
+		{"short", config.JWT{Secret: "short-secret"}},
+		{"placeholder", config.JWT{Secret: "YOUR_JWT_SECRET"}},
+		{"short key in JWT_KEYS", config.JWT{Keys: "a:HS256:changeme"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := InitJWTKeys(tt.cfg); err == nil {
+				t.Errorf("InitJWTKeys accepted %+v", tt.cfg)
+			}
+		})
+	}
+}
+
+func TestInitJWTKeysRejectsMalformedSpec(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.JWT
+	}{
+		{"missing parts", config.JWT{Keys: "a:HS256"}},
+		{"duplicate kid", config.JWT{Keys: "a:HS256:" + secretA + ",a:HS256:" + secretB}},
+		{"unknown algorithm", config.JWT{Keys: "a:ES256:" + secretA}},
+		{"active kid not defined", config.JWT{Keys: "a:HS256:" + secretA, ActiveKID: "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := InitJWTKeys(tt.cfg); err == nil {
+				t.Errorf("InitJWTKeys accepted %+v", tt.cfg)
+			}
+		})
+	}
+}
+
+func TestVerifyOnlyKeyCannotSign(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPath := writePEM(t, "PUBLIC KEY", pubDER)
+
+	err = InitJWTKeys(config.JWT{Keys: "ed:EdDSA:" + pubPath})
+	if err == nil || !strings.Contains(err.Error(), "cannot sign") {
+		t.Fatalf("InitJWTKeys with only a public key = %v, want a cannot sign error", err)
+	}
+
+	// Kept for verification next to a signing key, it still verifies
+	// tokens another service signed with the private half.
+	initKeys(t, config.JWT{Keys: "hmac:HS256:" + secretA + ",ed:EdDSA:" + pubPath})
+	if _, err := ParseJWT(signWith(t, jwt.SigningMethodEdDSA, "ed", priv)); err != nil {
+		t.Errorf("token from the verify-only key: %v", err)
+	}
+	token, err := CreateJWT(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header["kid"] != "hmac" {
+		t.Errorf("new token signed with kid %v, want the active hmac key", parsed.Header["kid"])
+	}
+}
+
+func TestSessionAndStateClaims(t *testing.T) {
+	initKeys(t, config.JWT{Secret: secretA})
+
+	session, err := CreateJWT(7, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := ParseJWT(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["sub"] != float64(7) || claims["ver"] != float64(3) {
+		t.Errorf("session claims = %v", claims)
+	}
+
+	login, err := CreateOIDCStateJWT("corp", "s", "n", "v", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, _ := ParseJWT(login); claims["reauth"] != nil {
+		t.Errorf("sign in state carries reauth = %v", claims["reauth"])
+	}
+	reauth, err := CreateOIDCStateJWT("corp", "s", "n", "v", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, _ := ParseJWT(reauth); claims["reauth"] != float64(7) {
+		t.Errorf("reauth state carries reauth = %v, want 7", claims["reauth"])
+	}
+}
@@ -0,0 +1,160 @@
+package views
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"example.com/m/v2/internal/middleware"
+)
+
+const (
+	FlashInfo    = "info"
+	FlashSuccess = "success"
+	FlashError   = "error"
+)
+
+const flashCookie = "flash"
+
+// maxFlashes keeps the cookie small when messages pile up unread.
+const maxFlashes = 5
+
+type Flash struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+func InfoFlash(message string) Flash    { return Flash{Level: FlashInfo, Message: message} }
+func SuccessFlash(message string) Flash { return Flash{Level: FlashSuccess, Message: message} }
+func ErrorFlash(message string) Flash   { return Flash{Level: FlashError, Message: message} }
+
+// AddFlash queues a message for the next page the browser renders, usually
+// right before a redirect. The cookie is signed so messages can't be forged
+// through a link the way ?flash= query strings could. Messages queued
+// earlier, by this response or a previous one, are kept.
+func AddFlash(w http.ResponseWriter, r *http.Request, flash Flash) {
+	flashes := append(queuedFlashes(w, r), flash)
+	if len(flashes) > maxFlashes {
+		flashes = flashes[len(flashes)-maxFlashes:]
+	}
+
+	payload, err := json.Marshal(flashes)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to encode flash", "error", err)
+		return
+	}
+	dropFlashCookie(w)
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signFlash(payload)),
+		Path:     "/",
+		MaxAge:   300,
+		HttpOnly: true,
+		Secure:   middleware.SecureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// queuedFlashes returns the messages waiting for the browser: the ones this
+// response already queued or, if it queued none, the ones the request carried.
+func queuedFlashes(w http.ResponseWriter, r *http.Request) []Flash {
+	if cookie := responseFlashCookie(w); cookie != nil {
+		if cookie.MaxAge < 0 {
+			return nil
+		}
+		return decodeFlashes(r, cookie.Value)
+	}
+	return readFlashes(r)
+}
+
+// pendingFlashes returns the queued messages for the page being rendered. A
+// response that queues a new message, such as an interstitial redirect page,
+// leaves them all for the next page.
+func pendingFlashes(w http.ResponseWriter, r *http.Request) []Flash {
+	if responseFlashCookie(w) != nil {
+		return nil
+	}
+	return readFlashes(r)
+}
+
+// clearFlashes deletes the cookie once a page has shown its messages, so each
+// one is shown once. Render calls it only after the page rendered; a failed
+// render keeps them for the next page.
+func clearFlashes(w http.ResponseWriter, r *http.Request) {
+	if _, err := r.Cookie(flashCookie); err != nil || responseFlashCookie(w) != nil {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   middleware.SecureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func responseFlashCookie(w http.ResponseWriter) *http.Cookie {
+	for _, header := range w.Header().Values("Set-Cookie") {
+		if cookie, err := http.ParseSetCookie(header); err == nil && cookie.Name == flashCookie {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func dropFlashCookie(w http.ResponseWriter) {
+	headers := w.Header().Values("Set-Cookie")
+	kept := headers[:0:0]
+	for _, header := range headers {
+		if cookie, err := http.ParseSetCookie(header); err != nil || cookie.Name != flashCookie {
+			kept = append(kept, header)
+		}
+	}
+	w.Header()["Set-Cookie"] = kept
+}
+
+func readFlashes(r *http.Request) []Flash {
+	cookie, err := r.Cookie(flashCookie)
+	if err != nil {
+		return nil
+	}
+	return decodeFlashes(r, cookie.Value)
+}
+
+func decodeFlashes(r *http.Request, value string) []Flash {
+	encoded, encodedMAC, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil || !hmac.Equal(mac, signFlash(payload)) {
+		slog.WarnContext(r.Context(), "ignoring flash cookie with an invalid signature")
+		return nil
+	}
+
+	var flashes []Flash
+	if err := json.Unmarshal(payload, &flashes); err != nil {
+		return nil
+	}
+	return flashes
+}
+
+// signFlash uses a key derived from the CSRF key, the application's cookie
+// secret, so the two never share a MAC key directly.
+func signFlash(payload []byte) []byte {
+	key := hmac.New(sha256.New, middleware.Profile().CSRFKey)
+	key.Write([]byte("flash"))
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
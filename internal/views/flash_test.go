@@ -0,0 +1,81 @@
+package views
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type redirectPage struct {
+	Layout
+	PageCSS string
+	Data    string
+}
+
+// withFlashCookie returns a request carrying the cookies rec set.
+func withFlashCookie(rec *httptest.ResponseRecorder) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+func flashCookies(rec *httptest.ResponseRecorder) []*http.Cookie {
+	var cookies []*http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == flashCookie {
+			cookies = append(cookies, cookie)
+		}
+	}
+	return cookies
+}
+
+func TestAddFlashKeepsMessagesQueuedByTheSameResponse(t *testing.T) {
+	first := httptest.NewRecorder()
+	AddFlash(first, httptest.NewRequest("GET", "/", nil), InfoFlash("from the last request"))
+
+	rec := httptest.NewRecorder()
+	req := withFlashCookie(first)
+	AddFlash(rec, req, SuccessFlash("one"))
+	AddFlash(rec, req, ErrorFlash("two"))
+
+	cookies := flashCookies(rec)
+	if len(cookies) != 1 {
+		t.Fatalf("response sets %d flash cookies, want 1", len(cookies))
+	}
+	next := httptest.NewRequest("GET", "/", nil)
+	next.AddCookie(cookies[0])
+	var got []string
+	for _, flash := range readFlashes(next) {
+		got = append(got, flash.Message)
+	}
+	if want := "from the last request,one,two"; strings.Join(got, ",") != want {
+		t.Errorf("queued messages = %q, want %q", got, want)
+	}
+}
+
+func TestRenderClearsFlashesOnlyAfterSuccess(t *testing.T) {
+	queued := httptest.NewRecorder()
+	AddFlash(queued, httptest.NewRequest("GET", "/", nil), SuccessFlash("Profile updated"))
+
+	rec := httptest.NewRecorder()
+	Must("layout.html", "redirect.html").Render(rec, withFlashCookie(queued), &redirectPage{Data: "/"})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Profile updated") {
+		t.Fatalf("status = %d, want the page with the queued message", rec.Code)
+	}
+	if cookies := flashCookies(rec); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Errorf("flash cookies after a successful render = %+v, want one deletion", cookies)
+	}
+
+	// The templates use fields this page lacks, so executing it fails.
+	rec = httptest.NewRecorder()
+	Must("layout.html", "redirect.html").Render(rec, withFlashCookie(queued), &struct{ Layout }{})
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if cookies := flashCookies(rec); len(cookies) != 0 {
+		t.Errorf("failed render touched the flash cookie: %+v", cookies)
+	}
+}
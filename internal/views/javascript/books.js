@@ -0,0 +1,14 @@
+document.addEventListener('DOMContentLoaded', function () {
+    const sort = document.getElementById('sort');
+    if (sort) {
+        sort.addEventListener('change', function () {
+            window.location.href = '/booksNYT?sort=' + encodeURIComponent(this.value);
+        });
+    }
+
+    document.querySelectorAll('.book_cont[data-href]').forEach(function (book) {
+        book.addEventListener('click', function () {
+            window.location.href = this.dataset.href;
+        });
+    });
+});
@@ -158,3 +158,12 @@ function cancelEdit() {
     document.getElementById('cancel-btn').style.display = 'none';
     document.getElementById('avatar-input').value = '';
 }
+
+document.addEventListener('DOMContentLoaded', function () {
+    const input = document.getElementById('avatar-input');
+    if (!input) return;
+
+    input.addEventListener('change', initAvatarEditor);
+    document.getElementById('upload-btn').addEventListener('click', uploadAvatar);
+    document.getElementById('cancel-btn').addEventListener('click', cancelEdit);
+});
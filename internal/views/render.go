@@ -0,0 +1,130 @@
+package views
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/csrf"
+
+	"example.com/m/v2/internal/middleware"
+	"example.com/m/v2/internal/tracing"
+)
+
+var funcs = template.FuncMap{
+	"asset": Asset,
+	"add":   func(a, b int) int { return a + b },
+	"minus": func(a, b int) int { return a - b },
+	"until": func(n int) []int {
+		arr := make([]int, n)
+		for i := range arr {
+			arr[i] = i
+		}
+		return arr
+	},
+	"smartPages": func(current, total int) []int {
+		pages := []int{}
+		start := current - 2
+		end := current + 2
+
+		if start < 1 {
+			start = 1
+			end = 5
+		}
+
+		if end > total {
+			end = total
+			start = total - 3
+			if start < 1 {
+				start = 1
+			}
+		}
+
+		for i := start; i <= end; i++ {
+			pages = append(pages, i)
+		}
+
+		return pages
+	},
+}
+
+var errorTmpl = Must("error.html")
+
+// Layout is the data every page shares. Page data embeds it and Render
+// fills in whatever the handler left empty.
+type Layout struct {
+	User interface{}
+	// Flashes holds the page's own messages; queued ones are appended.
+	Flashes   []Flash
+	CSRFToken string
+	CSPNonce  string
+}
+
+func (l *Layout) layout() *Layout { return l }
+
+type page interface {
+	layout() *Layout
+}
+
+func (l *Layout) fill(w http.ResponseWriter, r *http.Request) {
+	if l.User == nil {
+		l.User = r.Context().Value("userID")
+	}
+	l.Flashes = append(l.Flashes, pendingFlashes(w, r)...)
+	l.CSRFToken = csrf.Token(r)
+	l.CSPNonce = middleware.CSPNonce(r)
+}
+
+// Render executes the page layout with data, which should be a pointer to
+// a struct embedding Layout. The page is rendered into a buffer first so a
+// template error shows an error page instead of half-written HTML.
+func (t *Template) Render(w http.ResponseWriter, r *http.Request, data interface{}) {
+	p, isPage := data.(page)
+	if isPage {
+		p.layout().fill(w, r)
+	}
+
+	ctx, span := tracing.Tracer().Start(r.Context(), "template.render "+t.names[len(t.names)-1])
+	var buf bytes.Buffer
+	err := t.execute(&buf, "layout", data)
+	tracing.End(span, err)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to render template", "files", t.names, "error", err)
+		Error(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	if isPage {
+		clearFlashes(w, r)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+func (t *Template) execute(buf *bytes.Buffer, name string, data interface{}) error {
+	tmpl := t.lookup(name)
+	if tmpl == nil {
+		return fmt.Errorf("template %q not found in %v", name, t.names)
+	}
+	return tmpl.Execute(buf, data)
+}
+
+// Error writes a standalone error page that does not depend on the layout.
+func Error(w http.ResponseWriter, r *http.Request, status int) {
+	var buf bytes.Buffer
+	err := errorTmpl.execute(&buf, "error", struct {
+		Status int
+		Text   string
+	}{status, http.StatusText(status)})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to render error page", "error", err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
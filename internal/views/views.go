@@ -0,0 +1,160 @@
+// Package views holds the HTML templates and static assets, embedded into
+// the binary. Setting a views directory reads them from disk instead, so
+// edits show up without a rebuild.
+package views
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"example.com/m/v2/internal/config"
+)
+
+//go:embed *.html static javascript
+var embedded embed.FS
+
+var (
+	devDir string
+	// assetHashes maps embedded asset paths like "static/books.css" to a
+	// short content hash.
+	assetHashes = hashAssets(embedded)
+)
+
+var hashedName = regexp.MustCompile(`^(.+)\.([0-9a-f]{8})(\.[A-Za-z0-9]+)$`)
+
+// Init switches to reading templates and assets from cfg.Dir when it is set.
+func Init(cfg config.Views) error {
+	if cfg.Dir == "" {
+		devDir = ""
+		return nil
+	}
+	if _, err := os.Stat(path.Join(cfg.Dir, "layout.html")); err != nil {
+		return fmt.Errorf("views directory %s: %w", cfg.Dir, err)
+	}
+	devDir = cfg.Dir
+	slog.Info("Serving views from disk", "dir", devDir)
+	return nil
+}
+
+func files() fs.FS {
+	if devDir != "" {
+		return os.DirFS(devDir)
+	}
+	return embedded
+}
+
+func hashAssets(fsys fs.FS) map[string]string {
+	hashes := map[string]string{}
+	for _, dir := range []string{"static", "javascript"} {
+		fs.WalkDir(fsys, dir, func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			data, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(data)
+			hashes[name] = hex.EncodeToString(sum[:4])
+			return nil
+		})
+	}
+	return hashes
+}
+
+// Asset returns the URL of an asset such as "static/books.css". Embedded
+// assets get a content hash in their name so they can be cached forever;
+// assets read from disk keep their plain name.
+func Asset(name string) string {
+	if hash, ok := assetHashes[name]; ok && devDir == "" {
+		ext := path.Ext(name)
+		return "/" + strings.TrimSuffix(name, ext) + "." + hash + ext
+	}
+	return "/" + name
+}
+
+// AssetHandler serves the files under dir (static or javascript) at /dir/.
+// Requests for the current hashed name are marked immutable.
+func AssetHandler(dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Join(dir, path.Clean("/"+strings.TrimPrefix(r.URL.Path, "/"+dir+"/")))
+
+		cache := "no-cache"
+		if m := hashedName.FindStringSubmatch(name); m != nil {
+			original := m[1] + m[3]
+			if assetHashes[original] == m[2] && devDir == "" {
+				cache = "public, max-age=31536000, immutable"
+			}
+			name = original
+		}
+
+		fsys := files()
+		info, err := fs.Stat(fsys, name)
+		if err != nil || info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", cache)
+		http.ServeFileFS(w, r, fsys, name)
+	})
+}
+
+// Template is parsed once from the embedded files, or on every render when
+// reading from disk.
+type Template struct {
+	names  []string
+	mu     sync.Mutex
+	parsed *template.Template
+}
+
+// Parse parses the named files, for example "layout.html" and "books.html",
+// with the shared template functions.
+func Parse(names ...string) (*Template, error) {
+	t := &Template{names: names}
+	parsed, err := t.parse()
+	if err != nil {
+		return nil, err
+	}
+	t.parsed = parsed
+	return t, nil
+}
+
+func Must(names ...string) *Template {
+	t, err := Parse(names...)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func (t *Template) parse() (*template.Template, error) {
+	return template.New(t.names[0]).Funcs(funcs).ParseFS(files(), t.names...)
+}
+
+// lookup returns the named template. From disk, a template that no longer
+// parses is logged and the last good version is used.
+func (t *Template) lookup(name string) *template.Template {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if devDir != "" {
+		parsed, err := t.parse()
+		if err != nil {
+			slog.Error("failed to reload template", "files", t.names, "error", err)
+		} else {
+			t.parsed = parsed
+		}
+	}
+	return t.parsed.Lookup(name)
+}
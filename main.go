@@ -1,106 +1,89 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
-	"net/http"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 
-	"example.com/m/v2/internal/api"
-	"example.com/m/v2/internal/auth"
+	"example.com/m/v2/internal/config"
 	"example.com/m/v2/internal/database"
-	"example.com/m/v2/internal/handlers"
-	"example.com/m/v2/internal/middleware"
-	"example.com/m/v2/internal/services"
-	"github.com/gorilla/csrf"
-	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
-	"golang.org/x/time/rate"
+	"example.com/m/v2/internal/logging"
+	"example.com/m/v2/internal/migrate"
+	"example.com/m/v2/migrations"
 )
 
-func main() {
-	if err := godotenv.Load(); err != nil {
-		log.Println("No .env file found, using environment variables")
-	}
+const usage = `Usage: main [-config file.yaml] [command]
 
-	database.DB = database.Init()
-	defer database.DB.Close()
-
-	if err := services.InitCloudinary(); err != nil {
-		log.Println("Cloudinary not configured, avatar uploads will be disabled:", err)
-	}
+Commands:
+  serve                              run the web server (default)
+  migrate up | down [steps] | status manage the database schema
+  sync nyt                           replace the books with the current NYT lists
+  import <file.json>                 replace the books with a JSON file
+  user create -email E [-name N] [-admin]
+  user reset-password -email E
 
-	log.Println("Tables are managed via migrations in migrations/ folder")
+Passwords are prompted for, or read from standard input when it is not a terminal.
+`
 
-	count := database.CountBooks()
-	if count == 0 {
-		fmt.Println("Table is empty - downloading books from NYT API")
-		if err := api.UpdateBooksFromNYT(); err != nil {
-			log.Fatal("Error loading books:", err)
-		}
-		fmt.Println("Books successfully added")
-	} else {
-		fmt.Printf("Database contains %d books — skipping update\n", count)
+func main() {
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	configPath := flags.String("config", "", "YAML configuration file (default $CONFIG_FILE)")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
 	}
+	flags.Parse(os.Args[1:])
 
-	router := mux.NewRouter()
-
-	generalLimiter := middleware.NewRateLimiter(rate.Limit(10), 20)
-	generalLimiter.CleanupVisitors()
-
-	fs := http.FileServer(http.Dir("internal/views/static"))
-	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", fs))
-
-	js := http.FileServer(http.Dir("internal/views/javascript"))
-	router.PathPrefix("/javascript/").Handler(http.StripPrefix("/javascript/", js))
-
-	stylesheets := http.FileServer(http.Dir("stylesheets"))
-	router.PathPrefix("/stylesheets/").Handler(http.StripPrefix("/stylesheets/", stylesheets))
-
-	uploads := http.FileServer(http.Dir("uploads"))
-	router.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", uploads))
-
-	router.HandleFunc("/", handlers.RedirectToLogin)
+	command, args := "serve", flags.Args()
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	if command == "help" {
+		flags.Usage()
+		return
+	}
 
-	router.HandleFunc("/register", auth.RegisterPage).Methods("GET")
-	router.HandleFunc("/register", auth.RegisterSubmit).Methods("POST")
-	router.HandleFunc("/login", auth.LoginPage).Methods("GET")
-	router.HandleFunc("/login", auth.LoginSubmit).Methods("POST")
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	protected := router.PathPrefix("").Subrouter()
-	protected.Use(auth.AuthMiddleware)
-	protected.HandleFunc("/booksNYT", handlers.GetBooks).Methods("GET")
-	protected.HandleFunc("/book/{id}", handlers.GetBookByID).Methods("GET")
-	protected.HandleFunc("/profile", auth.ProfilePage).Methods("GET")
-	protected.HandleFunc("/profile/upload-avatar", auth.UploadAvatarHandler).Methods("POST")
-	protected.HandleFunc("/logout", auth.LogoutHandler).Methods("POST")
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	csrfKey := []byte(os.Getenv("CSRF_KEY"))
-	if len(csrfKey) == 0 {
-		csrfKey = []byte("32-byte-long-auth-key-change-me!")
-		log.Println("WARNING: Using default CSRF key. Set CSRF_KEY in production!")
+	if err := logging.Init(cfg.Log); err != nil {
+		log.Fatal("Invalid logging configuration: ", err)
 	}
+	slog.Info("Configuration loaded", "env", cfg.Env, "files", cfg.Files, "command", command)
 
-	csrfMiddleware := csrf.Protect(
-		csrfKey,
-		csrf.Secure(false),
-		csrf.Path("/"),
-		csrf.SameSite(csrf.SameSiteStrictMode),
-		csrf.TrustedOrigins([]string{"localhost:8000", "127.0.0.1:8000"}),
-	)
+	database.DB = database.Init(cfg.Database)
+	defer database.DB.Close()
 
-	handler := middleware.Logger(
-		middleware.SecurityHeaders(
-			generalLimiter.RateLimit(
-				csrfMiddleware(router),
-			),
-		),
-	)
+	migrator, err := migrate.New(database.DB, migrations.FS)
+	if err != nil {
+		log.Fatal("Invalid migrations: ", err)
+	}
 
-	fmt.Println("Server started on http://localhost:8000")
-	fmt.Println("— Security Headers enabled")
-	fmt.Println("— Rate Limiting enabled (10 req/s)")
-	fmt.Println("— CSRF Protection enabled")
-	fmt.Println("— Request Logging enabled")
-	log.Fatal(http.ListenAndServe(":8000", handler))
+	switch command {
+	case "serve":
+		err = serve(ctx, cfg, migrator)
+	case "migrate":
+		err = runMigrate(ctx, migrator, args)
+	case "sync":
+		err = runSync(ctx, cfg, args)
+	case "import":
+		err = runImport(ctx, args)
+	case "user":
+		err = runUser(ctx, args)
+	default:
+		err = fmt.Errorf("unknown command %q, run with -h for usage", command)
+	}
+	if err != nil {
+		database.DB.Close()
+		log.Fatal(err)
+	}
 }
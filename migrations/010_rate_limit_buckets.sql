@@ -0,0 +1,43 @@
+CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+    key TEXT PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_rate_limit_buckets_expires_at ON rate_limit_buckets (expires_at);
+
+-- Token bucket refill and take in one round trip; the row lock serialises
+-- concurrent requests for the same key across all replicas.
+CREATE OR REPLACE FUNCTION rate_limit_take(p_key TEXT, p_rate DOUBLE PRECISION, p_burst INT)
+RETURNS TABLE (allowed BOOLEAN, remaining DOUBLE PRECISION) AS $$
+DECLARE
+    ts TIMESTAMP WITH TIME ZONE := clock_timestamp();
+    b_tokens DOUBLE PRECISION;
+    b_updated TIMESTAMP WITH TIME ZONE;
+BEGIN
+    INSERT INTO rate_limit_buckets (key, tokens, updated_at, expires_at)
+    VALUES (p_key, p_burst, ts, ts)
+    ON CONFLICT (key) DO NOTHING;
+
+    SELECT b.tokens, b.updated_at INTO b_tokens, b_updated
+    FROM rate_limit_buckets b
+    WHERE b.key = p_key
+    FOR UPDATE;
+
+    b_tokens := LEAST(p_burst, b_tokens + GREATEST(0, EXTRACT(EPOCH FROM ts - b_updated)) * p_rate);
+    allowed := b_tokens >= 1;
+    IF allowed THEN
+        b_tokens := b_tokens - 1;
+    END IF;
+
+    UPDATE rate_limit_buckets
+    SET tokens = b_tokens,
+        updated_at = ts,
+        expires_at = ts + make_interval(secs => (p_burst - b_tokens) / p_rate)
+    WHERE key = p_key;
+
+    remaining := b_tokens;
+    RETURN NEXT;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,8 @@
+-- Emails are stored lowercase so sign in, sign up and email changes agree on
+-- which account an address belongs to. This fails if two accounts differ only
+-- in case; merge or rename one of them and run the migration again.
+UPDATE users SET email = lower(email) WHERE email <> lower(email);
+UPDATE email_verifications SET email = lower(email) WHERE email <> lower(email);
+UPDATE user_identities SET email = lower(email) WHERE email <> lower(email);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_lower ON users (lower(email));
@@ -0,0 +1,8 @@
+// Package migrations embeds the SQL migrations. NNN_name.sql applies a
+// change and the optional NNN_name.down.sql reverts it.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
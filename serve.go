@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"example.com/m/v2/internal/api"
+	"example.com/m/v2/internal/auth"
+	"example.com/m/v2/internal/config"
+	"example.com/m/v2/internal/database"
+	"example.com/m/v2/internal/handlers"
+	"example.com/m/v2/internal/metrics"
+	"example.com/m/v2/internal/middleware"
+	"example.com/m/v2/internal/migrate"
+	"example.com/m/v2/internal/services"
+	"example.com/m/v2/internal/tracing"
+	"example.com/m/v2/internal/utils"
+	"example.com/m/v2/internal/views"
+	"github.com/gorilla/mux"
+)
+
+// serve runs the web server until ctx is cancelled, then drains it.
+func serve(ctx context.Context, cfg *config.Config, migrator *migrate.Migrator) error {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	if cfg.Database.MigrateOnStart {
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			return fmt.Errorf("error applying migrations: %w", err)
+		}
+		slog.Info("Database schema is up to date", "applied", applied)
+	}
+
+	shutdownTracing, err := tracing.Init(context.Background(), cfg.Tracing)
+	if err != nil {
+		return fmt.Errorf("invalid tracing configuration: %w", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	if err := middleware.InitTrustedProxies(cfg.Security); err != nil {
+		return fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+	}
+
+	middleware.InitContentSecurityPolicy(cfg.Security)
+
+	if err := views.Init(cfg.Views); err != nil {
+		return fmt.Errorf("invalid VIEWS_DIR: %w", err)
+	}
+
+	if err := middleware.InitSecurityProfile(cfg); err != nil {
+		return fmt.Errorf("invalid security profile: %w", err)
+	}
+
+	if err := utils.InitJWTKeys(cfg.JWT); err != nil {
+		return fmt.Errorf("invalid JWT configuration: %w", err)
+	}
+
+	metrics.RegisterDB(database.DB)
+
+	api.Init(cfg.NYT)
+	auth.Init(cfg)
+	handlers.InitHealth(cfg.Health, migrator)
+
+	if err := services.InitCloudinary(cfg.Cloudinary); err != nil {
+		slog.Warn("Cloudinary not configured, avatar uploads will be disabled", "error", err)
+	}
+
+	if err := services.InitMailer(cfg.SMTP); err != nil {
+		return fmt.Errorf("error configuring mailer: %w", err)
+	}
+
+	if err := auth.InitOIDCProviders(context.Background(), cfg.OIDC); err != nil {
+		return fmt.Errorf("error configuring OIDC providers: %w", err)
+	}
+
+	count := database.CountBooks(context.Background())
+	if count == 0 {
+		slog.Info("Table is empty, downloading books from NYT API")
+		if err := api.UpdateBooksFromNYT(context.Background()); err != nil {
+			return fmt.Errorf("error loading books: %w", err)
+		}
+		slog.Info("Books successfully added")
+	} else {
+		slog.Info("Database already contains books, skipping update", "count", count)
+	}
+
+	router := mux.NewRouter()
+
+	policies, err := middleware.LoadRateLimitPolicies(cfg.RateLimit)
+	if err != nil {
+		return fmt.Errorf("invalid rate limit configuration: %w", err)
+	}
+	limitStore, err := middleware.NewRateLimitStore(cfg.RateLimit)
+	if err != nil {
+		return fmt.Errorf("invalid rate limit configuration: %w", err)
+	}
+	cleanupDone := middleware.StartRateLimitCleanup(ctx, limitStore, time.Minute)
+	limiters := map[string]*middleware.RateLimiter{}
+	for name, policy := range policies {
+		limiters[name] = middleware.NewRateLimiter(policy, limitStore)
+	}
+
+	purgerDone := auth.StartAccountPurger(ctx, time.Hour)
+
+	router.PathPrefix("/static/").Handler(views.AssetHandler("static"))
+	router.PathPrefix("/javascript/").Handler(views.AssetHandler("javascript"))
+
+	uploads := http.FileServer(http.Dir("uploads"))
+	router.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", uploads))
+
+	router.Handle("/metrics", metrics.Handler(cfg.Metrics)).Methods("GET")
+	router.HandleFunc("/csp-report", handlers.CSPReport).Methods("POST")
+
+	router.HandleFunc("/", handlers.RedirectToLogin)
+
+	router.HandleFunc("/register", auth.RegisterPage).Methods("GET")
+	router.HandleFunc("/register", auth.RegisterSubmit).Methods("POST")
+	router.HandleFunc("/login", auth.LoginPage).Methods("GET")
+	router.HandleFunc("/login", auth.LoginSubmit).Methods("POST")
+	router.HandleFunc("/login/2fa", auth.LoginTwoFactorPage).Methods("GET")
+	router.HandleFunc("/login/2fa", auth.LoginTwoFactorSubmit).Methods("POST")
+	router.HandleFunc("/auth/oidc/{provider}", auth.OIDCLoginHandler).Methods("GET")
+	router.HandleFunc("/auth/oidc/{provider}/callback", auth.OIDCCallbackHandler).Methods("GET")
+	router.HandleFunc("/verify-email", auth.VerifyEmailHandler).Methods("GET")
+
+	api := router.PathPrefix("/api").Subrouter()
+	apiRoute := func(scope string, h http.HandlerFunc) http.Handler {
+		return auth.TokenAuthMiddleware(scope)(limiters["api"].RateLimit(h))
+	}
+	api.Handle("/books", apiRoute("books:read", handlers.APIGetBooks)).Methods("GET")
+	api.Handle("/books/{id}", apiRoute("books:read", handlers.APIGetBookByID)).Methods("GET")
+	api.Handle("/me", apiRoute("profile:read", auth.APIMeHandler)).Methods("GET")
+
+	protected := router.PathPrefix("").Subrouter()
+	protected.Use(auth.AuthMiddleware)
+	// Avatars and API tokens are only available once the email address is
+	// confirmed.
+	verified := func(h http.HandlerFunc) http.Handler {
+		return auth.RequireVerifiedEmail(h)
+	}
+	protected.HandleFunc("/booksNYT", handlers.GetBooks).Methods("GET")
+	protected.HandleFunc("/book/{id}", handlers.GetBookByID).Methods("GET")
+	protected.HandleFunc("/profile", auth.ProfilePage).Methods("GET")
+	protected.Handle("/profile/upload-avatar", verified(auth.UploadAvatarHandler)).Methods("POST")
+	protected.HandleFunc("/profile/resend-verification", auth.ResendVerificationHandler).Methods("POST")
+	protected.HandleFunc("/profile/name", auth.UpdateNameHandler).Methods("POST")
+	protected.HandleFunc("/profile/email", auth.UpdateEmailHandler).Methods("POST")
+	protected.HandleFunc("/profile/password", auth.UpdatePasswordHandler).Methods("POST")
+	protected.HandleFunc("/profile/reauth/{provider}", auth.ReauthHandler).Methods("GET")
+	protected.HandleFunc("/profile/2fa/setup", auth.TwoFactorSetupPage).Methods("GET")
+	protected.HandleFunc("/profile/2fa/enable", auth.EnableTwoFactorHandler).Methods("POST")
+	protected.HandleFunc("/profile/2fa/disable", auth.DisableTwoFactorHandler).Methods("POST")
+	protected.Handle("/profile/tokens", verified(auth.CreateAPITokenHandler)).Methods("POST")
+	protected.HandleFunc("/profile/tokens/{id}/revoke", auth.RevokeAPITokenHandler).Methods("POST")
+	protected.HandleFunc("/profile/export", auth.ExportDataHandler).Methods("GET")
+	protected.HandleFunc("/profile/delete", auth.RequestDeletionHandler).Methods("POST")
+	protected.HandleFunc("/profile/delete/cancel", auth.CancelDeletionHandler).Methods("POST")
+	protected.HandleFunc("/logout", auth.LogoutHandler).Methods("POST")
+
+	admin := protected.PathPrefix("/admin").Subrouter()
+	admin.Use(auth.RequireAdmin)
+	admin.HandleFunc("/users", auth.AdminUsersPage).Methods("GET")
+	admin.HandleFunc("/users/{id}/reset-2fa", auth.AdminResetTwoFactorHandler).Methods("POST")
+	admin.HandleFunc("/users/{id}/unlock", auth.AdminUnlockUserHandler).Methods("POST")
+	admin.HandleFunc("/ip-locks/unlock", auth.AdminUnlockIPHandler).Methods("POST")
+	admin.HandleFunc("/users/{id}/role", auth.AdminChangeRoleHandler).Methods("POST")
+	admin.HandleFunc("/audit", auth.AdminAuditPage).Methods("GET")
+
+	handler := middleware.Tracing(router)(
+		middleware.RequestID(
+			middleware.Logger(
+				middleware.Metrics(router)(
+					middleware.SecurityHeaders(
+						middleware.RouteRateLimit(router, routeLimiter(limiters))(
+							middleware.CSRFExempt("/csp-report")(
+								middleware.CSRF()(router),
+							),
+						),
+					),
+				),
+			),
+		),
+	)
+
+	// Probes bypass the middleware chain: no auth, CSRF, rate limits or
+	// request logs.
+	root := http.NewServeMux()
+	root.HandleFunc("GET /healthz", handlers.Healthz)
+	root.HandleFunc("GET /readyz", handlers.Readyz)
+	root.Handle("/", handler)
+
+	server := &http.Server{
+		Addr:              cfg.Server.Addr,
+		Handler:           root,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+	slog.Info("Server started",
+		"addr", cfg.Server.Addr,
+		"security_headers", true,
+		"rate_limit_policies", len(limiters),
+		"csrf", true,
+		"profile", middleware.Profile().Name,
+	)
+
+	var serveErr error
+	select {
+	case serveErr = <-serverErr:
+		stop()
+	case <-ctx.Done():
+		slog.Info("Shutdown signal received, draining", "delay", cfg.Server.DrainDelay)
+		handlers.SetDraining()
+		time.Sleep(cfg.Server.DrainDelay)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Graceful shutdown timed out, closing connections", "error", err)
+			server.Close()
+		}
+	}
+
+	<-cleanupDone
+	<-purgerDone
+	if serveErr != nil {
+		return fmt.Errorf("server failed: %w", serveErr)
+	}
+	slog.Info("Server stopped")
+	return nil
+}
+
+// routeLimiter picks the per-IP limiter for a route template. API routes get
+// none here: apiRoute limits them per user, and a shared per-IP bucket with a
+// smaller burst would both override that and lump clients behind one NAT
+// together.
+func routeLimiter(limiters map[string]*middleware.RateLimiter) func(route, method string) *middleware.RateLimiter {
+	return func(route, method string) *middleware.RateLimiter {
+		switch {
+		case strings.HasPrefix(route, "/api/"):
+			return nil
+		case method == http.MethodPost && (route == "/login" || route == "/login/2fa" || route == "/register"):
+			return limiters["auth"]
+		case route == "/static/" || route == "/javascript/" || route == "/uploads/":
+			return limiters["static"]
+		}
+		return limiters["default"]
+	}
+}
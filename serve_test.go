@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"example.com/m/v2/internal/middleware"
+)
+
+// TestAPIRoutesUseOnlyThePerUserLimiter mirrors the serve wiring: a token
+// authenticated client gets the api burst, not the smaller per-IP default,
+// and a second client behind the same address has its own bucket.
+func TestAPIRoutesUseOnlyThePerUserLimiter(t *testing.T) {
+	store := middleware.NewMemoryRateLimitStore()
+	limiters := map[string]*middleware.RateLimiter{}
+	for name, policy := range middleware.DefaultRateLimitPolicies {
+		limiters[name] = middleware.NewRateLimiter(policy, store)
+	}
+	apiBurst := middleware.DefaultRateLimitPolicies["api"].Burst
+	if defaultBurst := middleware.DefaultRateLimitPolicies["default"].Burst; apiBurst <= defaultBurst {
+		t.Fatalf("api burst %d must exceed the default burst %d for this test", apiBurst, defaultBurst)
+	}
+
+	// Stands in for TokenAuthMiddleware, which needs the database.
+	tokenAuth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, _ := strconv.Atoi(r.Header.Get("Authorization"))
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "userID", userID)))
+		})
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	router := mux.NewRouter()
+	api := router.PathPrefix("/api").Subrouter()
+	api.Handle("/books", tokenAuth(limiters["api"].RateLimit(ok))).Methods("GET")
+	handler := middleware.RouteRateLimit(router, routeLimiter(limiters))(router)
+
+	get := func(userID int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/books", nil)
+		req.Header.Set("Authorization", strconv.Itoa(userID))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 1; i <= apiBurst; i++ {
+		if rec := get(1); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want the full api burst of %d", i, rec.Code, apiBurst)
+		}
+	}
+	rec := get(1)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("request past the burst: status = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if got := rec.Header().Get("RateLimit-Limit"); got != strconv.Itoa(apiBurst) {
+		t.Errorf("RateLimit-Limit = %q, want the api burst %d", got, apiBurst)
+	}
+
+	if rec := get(2); rec.Code != http.StatusOK {
+		t.Errorf("second user from the same address: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}